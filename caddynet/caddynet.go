@@ -4,5 +4,19 @@ import (
 	// plug in the server
 	_ "github.com/pieterlouw/caddy-net/caddynet/netserver"
 	// // plug in the standard directives
+	_ "github.com/pieterlouw/caddy-net/caddynet/dial"
+	_ "github.com/pieterlouw/caddy-net/caddynet/fanout"
+	_ "github.com/pieterlouw/caddy-net/caddynet/fault"
+	_ "github.com/pieterlouw/caddy-net/caddynet/graceperiod"
+	_ "github.com/pieterlouw/caddy-net/caddynet/group"
+	_ "github.com/pieterlouw/caddy-net/caddynet/healthcheck"
 	_ "github.com/pieterlouw/caddy-net/caddynet/host"
+	_ "github.com/pieterlouw/caddy-net/caddynet/mirror"
+	_ "github.com/pieterlouw/caddy-net/caddynet/prewarm"
+	_ "github.com/pieterlouw/caddy-net/caddynet/resolver"
+	_ "github.com/pieterlouw/caddy-net/caddynet/socket"
+	_ "github.com/pieterlouw/caddy-net/caddynet/token"
+	_ "github.com/pieterlouw/caddy-net/caddynet/transport"
+	_ "github.com/pieterlouw/caddy-net/caddynet/udp"
+	_ "github.com/pieterlouw/caddy-net/caddynet/upstream"
 )
@@ -0,0 +1,96 @@
+package dial
+
+import (
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("dial", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupDial,
+	})
+}
+
+// setupDial parses the dial directive which configures
+// how a proxy server block connects to its upstream:
+//
+//	dial {
+//		source         10.0.0.12
+//		family         ipv4|ipv6|prefer_ipv4|prefer_ipv6|any
+//		fallback_delay 250ms
+//		timeout        10s
+//	}
+func setupDial(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupDial if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "source":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				ip := net.ParseIP(c.Val())
+				if ip == nil {
+					return c.Errf("invalid source address '%s'", c.Val())
+				}
+				config.Dial.Source = ip
+
+			case "family":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				switch c.Val() {
+				case netserver.FamilyAny, netserver.FamilyIPv4, netserver.FamilyIPv6,
+					netserver.FamilyPreferIPv4, netserver.FamilyPreferIPv6:
+					config.Dial.Family = c.Val()
+				default:
+					return c.Errf("unknown address family '%s'", c.Val())
+				}
+
+			case "fallback_delay":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				d, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return c.Errf("invalid fallback_delay: %v", err)
+				}
+				config.Dial.FallbackDelay = d
+
+			case "timeout":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				d, err := time.ParseDuration(c.Val())
+				if err != nil {
+					return c.Errf("invalid timeout: %v", err)
+				}
+				config.Dial.Timeout = d
+
+			default:
+				return c.Errf("unknown dial property '%s'", c.Val())
+			}
+
+			if c.NextArg() {
+				// only one argument allowed
+				return c.ArgErr()
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,39 @@
+package fanout
+
+import (
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("fanout", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupFanout,
+	})
+}
+
+// setupFanout parses the fanout directive which copies every UDP
+// datagram a proxy server block receives to additional addresses:
+//
+//	fanout 10.0.0.8:8125 10.0.0.9:8125
+func setupFanout(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupFanout if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		if !config.ServesUDP() {
+			return c.Err("fanout requires the udp transport")
+		}
+		config.Fanout = append(config.Fanout, args...)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package fault
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("fault", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupFault,
+	})
+}
+
+// setupFault parses the fault directive which injects faults into the traffic
+// of a proxy server block. Each fault applies to a percentage of the connections,
+// all of them by default, except drop which drops a percentage of the datagrams:
+//
+//	fault {
+//		latency 100ms 20ms 50%
+//		bandwidth 65536
+//		reset 30s 1%
+//		drop 5%
+//		partial 16 10ms
+//		stall 1024 2%
+//		timeout 5s 1%
+//	}
+func setupFault(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupFault if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			fault := netserver.Fault{Type: c.Val(), Probability: 100}
+			args := c.RemainingArgs()
+
+			// a trailing percentage is the probability of the fault
+			if n := len(args); n > 0 && strings.HasSuffix(args[n-1], "%") {
+				p, err := strconv.ParseFloat(strings.TrimSuffix(args[n-1], "%"), 64)
+				if err != nil || p <= 0 || p > 100 {
+					return c.Errf("invalid fault percentage '%s'", args[n-1])
+				}
+				fault.Probability = p
+				args = args[:n-1]
+			} else if fault.Type == netserver.FaultDrop {
+				return c.Err("drop requires the percentage of datagrams to drop")
+			}
+
+			var err error
+			switch fault.Type {
+			case netserver.FaultLatency:
+				if len(args) == 0 || len(args) > 2 {
+					return c.ArgErr()
+				}
+				if fault.Delay, err = parseDuration(args[0]); err != nil {
+					return c.Errf("invalid latency '%s'", args[0])
+				}
+				if len(args) == 2 {
+					if fault.Jitter, err = parseDuration(args[1]); err != nil {
+						return c.Errf("invalid jitter '%s'", args[1])
+					}
+				}
+			case netserver.FaultBandwidth:
+				if len(args) != 1 {
+					return c.ArgErr()
+				}
+				if fault.Rate, err = parseBytes(args[0]); err != nil {
+					return c.Errf("invalid bandwidth '%s'", args[0])
+				}
+			case netserver.FaultReset:
+				if len(args) > 1 {
+					return c.ArgErr()
+				}
+				if len(args) == 1 {
+					if fault.Delay, err = parseDuration(args[0]); err != nil {
+						return c.Errf("invalid reset delay '%s'", args[0])
+					}
+				}
+			case netserver.FaultDrop:
+				if len(args) != 0 {
+					return c.ArgErr()
+				}
+				if !config.ServesUDP() {
+					return c.Err("drop requires the udp transport")
+				}
+			case netserver.FaultPartial:
+				if len(args) == 0 || len(args) > 2 {
+					return c.ArgErr()
+				}
+				if fault.Bytes, err = parseBytes(args[0]); err != nil {
+					return c.Errf("invalid partial write size '%s'", args[0])
+				}
+				if len(args) == 2 {
+					if fault.Delay, err = parseDuration(args[1]); err != nil {
+						return c.Errf("invalid partial write delay '%s'", args[1])
+					}
+				}
+			case netserver.FaultTimeout:
+				if len(args) > 1 {
+					return c.ArgErr()
+				}
+				if len(args) == 1 {
+					if fault.Delay, err = parseDuration(args[0]); err != nil {
+						return c.Errf("invalid timeout '%s'", args[0])
+					}
+				}
+			case netserver.FaultStall:
+				if len(args) != 1 {
+					return c.ArgErr()
+				}
+				if fault.Bytes, err = strconv.ParseInt(args[0], 10, 64); err != nil || fault.Bytes < 0 {
+					return c.Errf("invalid stall size '%s'", args[0])
+				}
+			default:
+				return c.Errf("unknown fault '%s'", fault.Type)
+			}
+
+			if fault.Type != netserver.FaultDrop && !config.ServesTCP() {
+				return c.Errf("%s requires the tcp transport", fault.Type)
+			}
+			config.Faults = append(config.Faults, fault)
+		}
+	}
+
+	return nil
+}
+
+// parseDuration parses a duration that isn't negative
+func parseDuration(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil && d < 0 {
+		err = strconv.ErrRange
+	}
+	return d, err
+}
+
+// parseBytes parses a positive number of bytes
+func parseBytes(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && n <= 0 {
+		err = strconv.ErrRange
+	}
+	return n, err
+}
@@ -0,0 +1,38 @@
+package graceperiod
+
+import (
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("grace_period", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupGracePeriod,
+	})
+}
+
+// setupGracePeriod parses the grace_period directive which sets the
+// time live connections get to finish when the server is stopped:
+//
+//	grace_period 30s
+func setupGracePeriod(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) != 1 {
+			return c.ArgErr()
+		}
+
+		d, err := time.ParseDuration(args[0])
+		if err != nil || d < 0 {
+			return c.Errf("invalid grace_period '%s'", args[0])
+		}
+		config.GracePeriod = d
+	}
+
+	return nil
+}
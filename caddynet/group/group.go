@@ -0,0 +1,88 @@
+package group
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("group", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupGroup,
+	})
+}
+
+// setupGroup parses the group directive which sends a percentage of the
+// traffic of a proxy server block to a named group of upstreams. The rest
+// of the traffic goes to the destination and upstreams of the block.
+// Addresses in a block may be followed by their weight, which is 1 otherwise:
+//
+//	group canary 5% 10.0.0.9:5432 {
+//		10.0.0.10:5432 2
+//	}
+func setupGroup(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupGroup if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	total := 0
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+
+		group := netserver.UpstreamGroup{Name: args[0], Upstreams: args[2:]}
+		if group.Name == netserver.DefaultGroup {
+			return c.Errf("group name '%s' is reserved", group.Name)
+		}
+		for _, g := range config.Groups {
+			if g.Name == group.Name {
+				return c.Errf("duplicate group '%s'", group.Name)
+			}
+		}
+
+		percent, err := strconv.Atoi(strings.TrimSuffix(args[1], "%"))
+		if err != nil || percent < 0 || percent > 100 {
+			return c.Errf("invalid group percentage '%s'", args[1])
+		}
+		total += percent
+		if total > 100 {
+			return c.Err("the percentages of the groups add up to more than 100%")
+		}
+		group.Percent = percent
+
+		for c.NextBlock() {
+			addr := c.Val()
+			group.Upstreams = append(group.Upstreams, addr)
+
+			weights := c.RemainingArgs()
+			if len(weights) > 1 {
+				return c.ArgErr()
+			}
+			if len(weights) == 1 {
+				weight, err := strconv.Atoi(weights[0])
+				if err != nil || weight < 0 {
+					return c.Errf("invalid weight '%s'", weights[0])
+				}
+				if config.Weights == nil {
+					config.Weights = make(map[string]int)
+				}
+				config.Weights[addr] = weight
+			}
+		}
+
+		if len(group.Upstreams) == 0 {
+			return c.ArgErr()
+		}
+		config.Groups = append(config.Groups, group)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package healthcheck
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("health_check", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupHealthCheck,
+	})
+}
+
+// setupHealthCheck parses the health_check directive which
+// probes the upstreams of a proxy server block:
+//
+//	health_check {
+//		interval   10s
+//		timeout    2s
+//		transport  tcp|udp
+//		send       PING
+//		expect     PONG
+//		send_hex   0001010000010000000000000003777777076578616d706c6503636f6d0000010001
+//		expect_hex 0001
+//	}
+func setupHealthCheck(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupHealthCheck if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	config.HealthCheck.Interval = netserver.DefaultHealthCheckInterval
+	config.HealthCheck.Timeout = netserver.DefaultHealthCheckTimeout
+
+	for c.Next() {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			property := c.Val()
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			switch property {
+			case "interval", "timeout":
+				d, err := time.ParseDuration(c.Val())
+				if err != nil || d <= 0 {
+					return c.Errf("invalid %s '%s'", property, c.Val())
+				}
+				if property == "interval" {
+					config.HealthCheck.Interval = d
+				} else {
+					config.HealthCheck.Timeout = d
+				}
+
+			case "transport":
+				if c.Val() != netserver.TransportTCP && c.Val() != netserver.TransportUDP {
+					return c.Errf("unknown health check transport '%s', expected tcp or udp", c.Val())
+				}
+				config.HealthCheck.Transport = c.Val()
+
+			case "send":
+				config.HealthCheck.Send = []byte(c.Val())
+
+			case "expect":
+				config.HealthCheck.Expect = []byte(c.Val())
+
+			case "send_hex", "expect_hex":
+				b, err := hex.DecodeString(c.Val())
+				if err != nil {
+					return c.Errf("invalid %s: %v", property, err)
+				}
+				if property == "send_hex" {
+					config.HealthCheck.Send = b
+				} else {
+					config.HealthCheck.Expect = b
+				}
+
+			default:
+				return c.Errf("unknown health_check property '%s'", property)
+			}
+
+			if c.NextArg() {
+				// only one argument allowed
+				return c.ArgErr()
+			}
+		}
+	}
+
+	// UDP-only server blocks are probed over UDP by default
+	udp := config.HealthCheck.Transport == netserver.TransportUDP ||
+		(config.HealthCheck.Transport == "" && !config.ServesTCP())
+	if udp && len(config.HealthCheck.Send) == 0 {
+		return c.Err("udp health checks require a payload to send")
+	}
+
+	return nil
+}
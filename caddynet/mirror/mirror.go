@@ -0,0 +1,56 @@
+package mirror
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("mirror", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupMirror,
+	})
+}
+
+// setupMirror parses the mirror directive which copies the TCP traffic
+// clients of a proxy server block send to a shadow upstream, optionally
+// for a percentage of the connections only:
+//
+//	mirror 10.0.0.9:5432 10%
+func setupMirror(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupMirror if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		if !config.ServesTCP() {
+			return c.Err("mirror requires the tcp transport")
+		}
+		if config.Mirror.Addr != "" {
+			return c.Err("mirror can only be specified once")
+		}
+
+		percent := 100.0
+		if len(args) == 2 {
+			p, err := strconv.ParseFloat(strings.TrimSuffix(args[1], "%"), 64)
+			if err != nil || p <= 0 || p > 100 {
+				return c.Errf("invalid mirror percentage '%s'", args[1])
+			}
+			percent = p
+		}
+
+		config.Mirror = netserver.MirrorConfig{Addr: args[0], Percent: percent}
+	}
+
+	return nil
+}
@@ -0,0 +1,187 @@
+package netserver
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bounds of the delay before accepting connections or reading datagrams
+// again after an error. It doubles with every consecutive error, as in
+// net/http, so that i.e. running out of file descriptors doesn't spin.
+const (
+	minRetryDelay = 5 * time.Millisecond
+	maxRetryDelay = time.Second
+)
+
+// listeners returns ln and, if c shares the address through SO_REUSEPORT,
+// the other listeners on addr. They all apply the options of c to the
+// connections they accept, and are wrapped with TLS if tlsConfig is set.
+// Listeners that can't be opened, i.e. because ln was inherited from an
+// instance without SO_REUSEPORT, are logged and left out.
+func (c SocketConfig) listeners(ln net.Listener, addr string, tlsConfig *tls.Config) []net.Listener {
+	lns := []net.Listener{ln}
+	for i := 1; i < c.ReusePort; i++ {
+		extra, err := c.Listen(addr)
+		if err != nil {
+			log.Printf("[WARNING] Opening listener %d of %s with SO_REUSEPORT: %v", i+1, addr, err)
+			break
+		}
+		lns = append(lns, extra)
+	}
+
+	for i := range lns {
+		lns[i] = &socketListener{Listener: lns[i], config: c}
+		if tlsConfig != nil {
+			lns[i] = tls.NewListener(lns[i], tlsConfig)
+		}
+	}
+	return lns
+}
+
+// acceptLoops accepts connections on each of lns in its own loop and
+// passes them to handle. It returns the error that ends the loop of the
+// first listener, once its listener is closed, after closing the others.
+// Other errors are counted in metrics and retried after a delay.
+func acceptLoops(lns []net.Listener, handle func(net.Conn), metrics *expvar.Map) error {
+	for _, ln := range lns[1:] {
+		go acceptLoop(ln, handle, metrics)
+	}
+	defer func() {
+		for _, ln := range lns[1:] {
+			ln.Close()
+		}
+	}()
+
+	return acceptLoop(lns[0], handle, metrics)
+}
+
+// acceptLoop accepts connections on ln and passes them
+// to handle until ln is closed
+func acceptLoop(ln net.Listener, handle func(net.Conn), metrics *expvar.Map) error {
+	var retry retryDelay
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isClosed(err) {
+				return err
+			}
+			metrics.Add("accept_errors", 1)
+			retry.Wait(err, "Accepting connection on %s", ln.Addr())
+			continue
+		}
+		retry.Reset()
+		handle(conn)
+	}
+}
+
+// isClosed returns true if err is returned because the listener or
+// connection was closed, the only error that ends accepting or reading
+func isClosed(err error) bool {
+	// net.ErrClosed requires Go 1.16, this is what caddy checks for too
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// retryDelay is the delay before retrying after consecutive errors.
+// It's safe for concurrent use.
+type retryDelay struct {
+	mu    sync.Mutex
+	delay time.Duration
+}
+
+// Wait logs err, which happened while doing what is described by
+// format and args, and sleeps for longer after every consecutive error
+func (r *retryDelay) Wait(err error, format string, args ...interface{}) {
+	r.mu.Lock()
+	if r.delay == 0 {
+		r.delay = minRetryDelay
+	} else if r.delay *= 2; r.delay > maxRetryDelay {
+		r.delay = maxRetryDelay
+	}
+	d := r.delay
+	r.mu.Unlock()
+
+	log.Printf("[ERROR] %s: %v; retrying in %v", fmt.Sprintf(format, args...), err, d)
+	time.Sleep(d)
+}
+
+// Reset starts over with the shortest delay after a success
+func (r *retryDelay) Reset() {
+	r.mu.Lock()
+	r.delay = 0
+	r.mu.Unlock()
+}
+
+// serverListeners holds the listeners of a server, which Serve and
+// ServePacket set while Stop may be closing them concurrently
+type serverListeners struct {
+	mu      sync.Mutex
+	tcp     []net.Listener
+	udp     net.PacketConn
+	stopped bool
+}
+
+// SetTCP keeps lns to be closed by Close. If the server is stopped
+// already it closes them instead and returns false.
+func (l *serverListeners) SetTCP(lns []net.Listener) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		closeListeners(lns)
+		return false
+	}
+	l.tcp = lns
+	return true
+}
+
+// SetUDP keeps con to be closed by Close. If the server is stopped
+// already it closes con instead and returns false.
+func (l *serverListeners) SetUDP(con net.PacketConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		con.Close()
+		return false
+	}
+	l.udp = con
+	return true
+}
+
+// Close closes the listeners, and those set later as soon as they
+// are set, and returns the first error
+func (l *serverListeners) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.stopped = true
+
+	var err error
+	if l.tcp != nil {
+		err = closeListeners(l.tcp)
+	}
+	if l.udp != nil {
+		if uerr := l.udp.Close(); err == nil {
+			err = uerr
+		}
+	}
+	return err
+}
+
+// closeListeners closes lns and returns the first error. Listeners
+// that are closed already, i.e. by acceptLoops, are skipped.
+func closeListeners(lns []net.Listener) error {
+	var err error
+	for _, ln := range lns {
+		if cerr := ln.Close(); err == nil && cerr != nil && !isClosed(cerr) {
+			err = cerr
+		}
+	}
+	return err
+}
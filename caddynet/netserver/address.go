@@ -0,0 +1,101 @@
+package netserver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// addressMapping pairs an address a server listens on with the
+// address it forwards traffic to. Dest is empty for echo servers.
+type addressMapping struct {
+	Listen string
+	Dest   string
+}
+
+// mapAddresses expands the port ranges in the listen and destination
+// addresses of c and pairs every listen address with its destination.
+// A destination range maps 1:1 onto each listen range, a single
+// destination port receives the traffic of every listen address (N:1).
+func mapAddresses(c *Config) ([]addressMapping, error) {
+	var dests []string
+	if c.DestAddr != "" {
+		var err error
+		dests, err = expandPortRange(c.DestAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var mappings []addressMapping
+	for _, l := range c.ListenAddrs {
+		listen, err := expandPortRange(l)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(dests) > 1 && len(dests) != len(listen) {
+			return nil, fmt.Errorf("port range of %s does not match destination %s", l, c.DestAddr)
+		}
+
+		for i, addr := range listen {
+			m := addressMapping{Listen: addr}
+			switch len(dests) {
+			case 0:
+			case 1:
+				m.Dest = dests[0]
+			default:
+				m.Dest = dests[i]
+			}
+			mappings = append(mappings, m)
+		}
+	}
+
+	return mappings, nil
+}
+
+// expandPortRange expands an address of the form host:first-last into
+// an address for every port in the range. Addresses without a range,
+// or that aren't host:port pairs, are returned as is.
+func expandPortRange(addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || !strings.Contains(port, "-") {
+		return []string{addr}, nil
+	}
+
+	bounds := strings.SplitN(port, "-", 2)
+	first, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %s: %v", port, err)
+	}
+	last, err := strconv.ParseUint(bounds[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %s: %v", port, err)
+	}
+	if first > last {
+		return nil, fmt.Errorf("invalid port range %s: first port is greater than last port", port)
+	}
+
+	addrs := make([]string, 0, last-first+1)
+	for p := first; p <= last; p++ {
+		addrs = append(addrs, net.JoinHostPort(host, strconv.FormatUint(p, 10)))
+	}
+
+	return addrs, nil
+}
+
+// serverAddress returns the address a server listening on l identifies
+// itself with. It's prefixed with the transport unless the server listens
+// on both, as servers of different server blocks may share a port on
+// different transports.
+func serverAddress(l string, c *Config) string {
+	switch {
+	case c.ServesTCP() && c.ServesUDP():
+		return l
+	case c.ServesTCP():
+		return TransportTCP + "/" + l
+	default:
+		return TransportUDP + "/" + l
+	}
+}
@@ -0,0 +1,783 @@
+package netserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy"
+)
+
+// adminShutdownTimeout is how long requests to the admin
+// API get to finish when the admin server is stopped
+const adminShutdownTimeout = 5 * time.Second
+
+// unixPrefix marks an admin address that is a unix socket path,
+// i.e unix//run/caddynet.sock
+const unixPrefix = "unix/"
+
+// serverBlock is an echo or proxy server block with the servers made for it
+type serverBlock struct {
+	config  *Config
+	echoes  []*EchoServer
+	proxies []*ProxyServer
+}
+
+// Name returns the name of the block in the admin API, which is its
+// first listen address, prefixed with the transport if it's set.
+func (b *serverBlock) Name() string {
+	if b.config.Transport == TransportBoth {
+		return b.config.ListenAddrs[0]
+	}
+	return b.config.Transport + "/" + b.config.ListenAddrs[0]
+}
+
+// trackers returns the live connections of each server of the block
+func (b *serverBlock) trackers() []*connTracker {
+	var trackers []*connTracker
+	for _, s := range b.echoes {
+		trackers = append(trackers, s.conns)
+	}
+	for _, s := range b.proxies {
+		trackers = append(trackers, s.conns)
+	}
+	return trackers
+}
+
+// sessions returns the UDP sessions of each proxy server of the block
+func (b *serverBlock) sessions() []*udpSessionTable {
+	var tables []*udpSessionTable
+	for _, s := range b.proxies {
+		tables = append(tables, s.udpClients)
+	}
+	return tables
+}
+
+// AdminServer is a local HTTP API for inspecting and changing the server
+// blocks of a Caddy instance and their live connections at runtime. It
+// implements the caddy.GracefulServer interface type.
+type AdminServer struct {
+	LocalTCPAddr string
+	config       *Config
+	blocks       []*serverBlock
+	server       *http.Server
+}
+
+// NewAdminServer returns a new admin server, which manages the
+// server blocks of its instance once MakeServers made them
+func NewAdminServer(l string, c *Config) *AdminServer {
+	s := &AdminServer{
+		LocalTCPAddr: l,
+		config:       c,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/proxies", s.handleProxies)
+	mux.HandleFunc("/proxies/", s.handleProxy)
+	mux.HandleFunc("/connections", s.handleConnections)
+	mux.HandleFunc("/connections/", s.handleConnection)
+	mux.Handle("/debug/vars", expvar.Handler())
+	s.server = &http.Server{Handler: s.authenticate(mux)}
+
+	return s
+}
+
+// Address returns the address s listens on
+func (s *AdminServer) Address() string {
+	return s.LocalTCPAddr
+}
+
+// WrapListener returns ln as is, as admin servers
+// don't have listener middleware
+func (s *AdminServer) WrapListener(ln net.Listener) net.Listener {
+	return ln
+}
+
+// Listen starts listening by creating a new listener
+// and returning it. It does not start accepting
+// connections.
+func (s *AdminServer) Listen() (net.Listener, error) {
+	if !strings.HasPrefix(s.LocalTCPAddr, unixPrefix) {
+		return net.Listen("tcp", s.LocalTCPAddr)
+	}
+
+	// the socket of a previous process that didn't hand it over is stale
+	path := strings.TrimPrefix(s.LocalTCPAddr, unixPrefix)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// the socket stays when the listener is closed, as it may
+	// have been handed over to a new instance on a reload
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	return ln, nil
+}
+
+// ListenPacket returns nil, as the admin API is only served over TCP
+func (s *AdminServer) ListenPacket() (net.PacketConn, error) {
+	return nil, nil
+}
+
+// Serve serves the admin API on ln until s is stopped
+func (s *AdminServer) Serve(ln net.Listener) error {
+	if ln == nil {
+		return nil
+	}
+
+	err := s.server.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ServePacket returns at once, as the admin API is only served over TCP
+func (s *AdminServer) ServePacket(con net.PacketConn) error {
+	return nil
+}
+
+// Stop stops s, letting the requests in progress finish
+func (s *AdminServer) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+
+	return s.server.Shutdown(ctx)
+}
+
+// OnStartupComplete lists the address of the admin API
+func (s *AdminServer) OnStartupComplete() {
+	if !caddy.Quiet {
+		fmt.Printf("[INFO] Serving the admin API on %s\n", s.LocalTCPAddr)
+	}
+}
+
+// authenticate requires the requests to next to carry the token
+// of the admin server block as bearer token, if it has one
+func (s *AdminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config.Token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				adminError(w, http.StatusUnauthorized, "invalid token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticated returns true if requests to s are authenticated, either
+// by a token or by the permissions of the unix socket s listens on
+func (s *AdminServer) authenticated() bool {
+	return s.config.Token != "" || strings.HasPrefix(s.LocalTCPAddr, unixPrefix)
+}
+
+// handleProxies serves the list of proxy server blocks
+func (s *AdminServer) handleProxies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		adminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	views := make([]proxyView, 0, len(s.blocks))
+	for _, b := range s.blocks {
+		if b.config.Type == "proxy" {
+			views = append(views, newProxyView(b))
+		}
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	adminJSON(w, http.StatusOK, views)
+}
+
+// handleProxy serves a single proxy server block at /proxies/<name>, its
+// upstreams at /proxies/<name>/upstreams, its upstream groups at
+// /proxies/<name>/groups/<group> and its faults at
+// /proxies/<name>/faults[/<fault>]. Names may contain slashes, i.e
+// udp/:53, so the upstreams, groups and faults are matched first.
+func (s *AdminServer) handleProxy(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/proxies/")
+
+	fault, faults, upstreams, group := "", false, false, ""
+	if strings.HasSuffix(name, "/upstreams") {
+		name, upstreams = strings.TrimSuffix(name, "/upstreams"), true
+	} else if i := strings.LastIndex(name, "/groups/"); i >= 0 {
+		name, group = name[:i], name[i+len("/groups/"):]
+	} else if i := strings.LastIndex(name, "/faults"); i >= 0 {
+		rest := name[i+len("/faults"):]
+		if rest == "" || strings.HasPrefix(rest, "/") {
+			name, fault, faults = name[:i], strings.TrimPrefix(rest, "/"), true
+		}
+	}
+
+	b := s.block(name)
+	if b == nil || b.config.Type != "proxy" {
+		adminError(w, http.StatusNotFound, "unknown proxy %s", name)
+		return
+	}
+
+	switch {
+	case upstreams:
+		s.handleUpstreams(w, r, b)
+	case group != "":
+		s.handleGroup(w, r, b, group)
+	case !faults && r.Method == http.MethodGet:
+		adminJSON(w, http.StatusOK, newProxyView(b))
+	case faults && fault == "" && r.Method == http.MethodGet:
+		adminJSON(w, http.StatusOK, newFaultViews(b.config.faults.List()))
+	case faults && fault == "" && r.Method == http.MethodPost:
+		s.addFault(w, r, b)
+	case faults && fault != "" && r.Method == http.MethodDelete:
+		s.removeFault(w, b, fault)
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// upstreamRequest is the JSON body of a request changing an upstream
+type upstreamRequest struct {
+	Address string `json:"address"`
+	Group   string `json:"group"`
+	Weight  *int   `json:"weight"`
+	Drained *bool  `json:"drained"`
+}
+
+// handleUpstreams serves the upstreams of the proxy server block b, and
+// adds (POST), changes (PATCH) or removes (DELETE) an upstream of all its
+// servers. Changes require an authenticated admin API.
+func (s *AdminServer) handleUpstreams(w http.ResponseWriter, r *http.Request, b *serverBlock) {
+	if r.Method == http.MethodGet {
+		adminJSON(w, http.StatusOK, newProxyView(b).Servers)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPatch && r.Method != http.MethodDelete {
+		adminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if !s.authenticated() {
+		adminError(w, http.StatusForbidden, "changing upstreams requires a token or a unix socket")
+		return
+	}
+
+	var req upstreamRequest
+	if r.Method == http.MethodDelete {
+		req.Address, req.Group = r.URL.Query().Get("address"), r.URL.Query().Get("group")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid upstream: %v", err)
+		return
+	}
+	if req.Address == "" {
+		adminError(w, http.StatusBadRequest, "missing upstream address")
+		return
+	}
+
+	var change func(p *ProxyServer) error
+	var action string
+	switch r.Method {
+	case http.MethodPost:
+		action = "Added"
+		group, weight := req.Group, 1
+		if group == "" {
+			group = DefaultGroup
+		}
+		if req.Weight != nil {
+			weight = *req.Weight
+		}
+		change = func(p *ProxyServer) error { return p.AddUpstream(group, req.Address, weight) }
+	case http.MethodPatch:
+		if req.Weight == nil && req.Drained == nil {
+			adminError(w, http.StatusBadRequest, "missing weight or drained")
+			return
+		}
+		action = "Changed"
+		change = func(p *ProxyServer) error {
+			if req.Weight != nil {
+				if err := p.SetUpstreamWeight(req.Address, *req.Weight); err != nil {
+					return err
+				}
+			}
+			if req.Drained != nil {
+				return p.DrainUpstream(req.Address, *req.Drained)
+			}
+			return nil
+		}
+	case http.MethodDelete:
+		action = "Removed"
+		change = func(p *ProxyServer) error { return p.RemoveUpstream(req.Group, req.Address) }
+	}
+
+	// the servers of a block have the same groups, so they fail alike
+	for _, p := range b.proxies {
+		if err := change(p); err != nil {
+			adminError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	log.Printf("[INFO] %s upstream %s of proxy %s", action, req.Address, b.Name())
+	adminJSON(w, http.StatusOK, newProxyView(b).Servers)
+}
+
+// groupRequest is the JSON body of a request changing an upstream group
+type groupRequest struct {
+	Weight *int `json:"weight"`
+}
+
+// handleGroup changes (PATCH) the weight of the upstream group called
+// name of all servers of the proxy server block b. Changes require an
+// authenticated admin API.
+func (s *AdminServer) handleGroup(w http.ResponseWriter, r *http.Request, b *serverBlock, name string) {
+	if r.Method != http.MethodPatch {
+		adminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if !s.authenticated() {
+		adminError(w, http.StatusForbidden, "changing upstream groups requires a token or a unix socket")
+		return
+	}
+
+	var req groupRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid group: %v", err)
+		return
+	}
+	if req.Weight == nil {
+		adminError(w, http.StatusBadRequest, "missing weight")
+		return
+	}
+
+	// the servers of a block have the same groups, so they fail alike
+	for _, p := range b.proxies {
+		if err := p.SetGroupWeight(name, *req.Weight); err != nil {
+			adminError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+	}
+	log.Printf("[INFO] Changed weight of upstream group %s of proxy %s to %d", name, b.Name(), *req.Weight)
+	adminJSON(w, http.StatusOK, newProxyView(b).Servers)
+}
+
+// addFault adds the fault in the body of r to the proxy server
+// block b. It requires an authenticated admin API.
+func (s *AdminServer) addFault(w http.ResponseWriter, r *http.Request, b *serverBlock) {
+	if !s.authenticated() {
+		adminError(w, http.StatusForbidden, "changing faults requires a token or a unix socket")
+		return
+	}
+
+	var v faultView
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		adminError(w, http.StatusBadRequest, "invalid fault: %v", err)
+		return
+	}
+	f, err := v.fault()
+	if err == nil && f.Type == FaultDrop && !b.config.ServesUDP() {
+		err = fmt.Errorf("%s requires the udp transport", f.Type)
+	}
+	if err == nil && f.Type != FaultDrop && !b.config.ServesTCP() {
+		err = fmt.Errorf("%s requires the tcp transport", f.Type)
+	}
+	if err != nil {
+		adminError(w, http.StatusBadRequest, "invalid fault: %v", err)
+		return
+	}
+
+	f, err = b.config.faults.Add(f)
+	if err != nil {
+		adminError(w, http.StatusConflict, "%v", err)
+		return
+	}
+	log.Printf("[INFO] Added %s fault %s to proxy %s", f.Type, f.Name, b.Name())
+	adminJSON(w, http.StatusCreated, newFaultView(f))
+}
+
+// removeFault removes the fault called name from the proxy server
+// block b. It requires an authenticated admin API.
+func (s *AdminServer) removeFault(w http.ResponseWriter, b *serverBlock, name string) {
+	if !s.authenticated() {
+		adminError(w, http.StatusForbidden, "changing faults requires a token or a unix socket")
+		return
+	}
+
+	if !b.config.faults.Remove(name) {
+		adminError(w, http.StatusNotFound, "unknown fault %s", name)
+		return
+	}
+	log.Printf("[INFO] Removed fault %s from proxy %s", name, b.Name())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleConnections serves the live TCP connections and UDP sessions of
+// the server blocks, or closes them if the method is DELETE. The block and ip parameters
+// select the connections of a server block or from a client IP. Closing
+// connections requires an authenticated admin API.
+func (s *AdminServer) handleConnections(w http.ResponseWriter, r *http.Request) {
+	blocks := s.blocks
+	if name := r.URL.Query().Get("block"); name != "" {
+		b := s.block(name)
+		if b == nil {
+			adminError(w, http.StatusNotFound, "unknown server block %s", name)
+			return
+		}
+		blocks = []*serverBlock{b}
+	}
+
+	var ip net.IP
+	if v := r.URL.Query().Get("ip"); v != "" {
+		if ip = net.ParseIP(v); ip == nil {
+			adminError(w, http.StatusBadRequest, "invalid ip %s", v)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		views := make([]blockConnsView, 0, len(blocks))
+		for _, b := range blocks {
+			views = append(views, newBlockConnsView(b, ip))
+		}
+		sort.Slice(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+		adminJSON(w, http.StatusOK, views)
+	case http.MethodDelete:
+		if !s.authenticated() {
+			adminError(w, http.StatusForbidden, "closing connections requires a token or a unix socket")
+			return
+		}
+		// closing every connection at once takes an explicit ip
+		if ip == nil {
+			adminError(w, http.StatusBadRequest, "closing connections requires an ip")
+			return
+		}
+		closed := 0
+		for _, b := range blocks {
+			for _, t := range b.trackers() {
+				closed += t.CloseFrom(ip)
+			}
+			for _, t := range b.sessions() {
+				closed += t.CloseFrom(ip)
+			}
+		}
+		log.Printf("[INFO] Closed %d connections from %s", closed, ip)
+		adminJSON(w, http.StatusOK, map[string]int{"closed": closed})
+	default:
+		adminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+	}
+}
+
+// handleConnection closes the TCP connection or UDP session at
+// /connections/<id>, which requires an authenticated admin API
+func (s *AdminServer) handleConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		adminError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if !s.authenticated() {
+		adminError(w, http.StatusForbidden, "closing connections requires a token or a unix socket")
+		return
+	}
+
+	v := strings.TrimPrefix(r.URL.Path, "/connections/")
+	id, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		adminError(w, http.StatusNotFound, "unknown connection %s", v)
+		return
+	}
+
+	for _, b := range s.blocks {
+		for _, t := range b.trackers() {
+			if t.Close(id) {
+				log.Printf("[INFO] Closed connection %d of %s", id, b.Name())
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		for _, t := range b.sessions() {
+			if t.Close(id) {
+				log.Printf("[INFO] Closed UDP session %d of %s", id, b.Name())
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+	}
+	adminError(w, http.StatusNotFound, "unknown connection %s", v)
+}
+
+// block returns the server block called name, or nil
+func (s *AdminServer) block(name string) *serverBlock {
+	for _, b := range s.blocks {
+		if b.Name() == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// adminJSON writes v as the JSON response with status code
+func adminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// adminError writes an error response with status code
+func adminError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	adminJSON(w, code, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+// proxyView is the JSON representation of a proxy server block
+type proxyView struct {
+	Name      string       `json:"name"`
+	Transport string       `json:"transport"`
+	Servers   []serverView `json:"servers"`
+	Faults    []faultView  `json:"faults"`
+}
+
+// serverView is the JSON representation of a proxy server
+type serverView struct {
+	Address string      `json:"address"`
+	Dest    string      `json:"destination"`
+	Groups  []groupView `json:"groups"`
+}
+
+// groupView is the JSON representation of an upstream group
+type groupView struct {
+	Name      string         `json:"name"`
+	Weight    int32          `json:"weight"`
+	Upstreams []upstreamView `json:"upstreams"`
+}
+
+// upstreamView is the JSON representation of an upstream
+type upstreamView struct {
+	Addr     string `json:"address"`
+	Priority int    `json:"priority"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	Drained  bool   `json:"drained"`
+}
+
+func newProxyView(b *serverBlock) proxyView {
+	v := proxyView{
+		Name:      b.Name(),
+		Transport: b.config.Transport,
+		Faults:    newFaultViews(b.config.faults.List()),
+	}
+
+	for _, s := range b.proxies {
+		sv := serverView{Address: s.LocalTCPAddr, Dest: s.DestTCPAddr}
+		for _, g := range s.upstreams.groups {
+			gv := groupView{Name: g.name, Weight: atomic.LoadInt32(&g.weight), Upstreams: []upstreamView{}}
+			for _, u := range g.pool.views() {
+				gv.Upstreams = append(gv.Upstreams, u)
+			}
+			sv.Groups = append(sv.Groups, gv)
+		}
+		v.Servers = append(v.Servers, sv)
+	}
+	return v
+}
+
+// blockConnsView is the JSON representation of the live
+// TCP connections and UDP sessions of a server block
+type blockConnsView struct {
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Connections []connView `json:"connections"`
+}
+
+// connView is the JSON representation of a live TCP connection or UDP
+// session. Bytes are counted from the client's side of the connection.
+type connView struct {
+	ID        uint64   `json:"id"`
+	Transport string   `json:"transport"`
+	Server    string   `json:"server"`
+	Client    string   `json:"client"`
+	Upstream  string   `json:"upstream,omitempty"`
+	Started   string   `json:"started"`
+	Age       string   `json:"age"`
+	Received  uint64   `json:"bytes_received"`
+	Sent      uint64   `json:"bytes_sent"`
+	TLS       *tlsView `json:"tls,omitempty"`
+	Dropped   int64    `json:"datagrams_dropped,omitempty"` // datagrams of a UDP session that didn't fit in its queue
+}
+
+// tlsView is the JSON representation of the TLS state of a connection
+type tlsView struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	Protocol    string `json:"protocol,omitempty"`
+}
+
+// tlsVersions are the names of the TLS versions
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// newBlockConnsView returns the view of the live connections of b,
+// only those from ip if it's set
+func newBlockConnsView(b *serverBlock, ip net.IP) blockConnsView {
+	v := blockConnsView{Name: b.Name(), Type: b.config.Type, Connections: []connView{}}
+	for _, t := range b.trackers() {
+		for _, c := range t.List() {
+			addr, _ := c.RemoteAddr().(*net.TCPAddr)
+			if ip != nil && (addr == nil || !addr.IP.Equal(ip)) {
+				continue
+			}
+			v.Connections = append(v.Connections, newConnView(c))
+		}
+	}
+	for _, t := range b.sessions() {
+		for _, p := range t.List() {
+			addr, _ := p.laddr.(*net.UDPAddr)
+			if ip != nil && (addr == nil || !addr.IP.Equal(ip)) {
+				continue
+			}
+			v.Connections = append(v.Connections, newSessionView(t.server, p))
+		}
+	}
+	return v
+}
+
+func newConnView(c *trackedConn) connView {
+	v := connView{
+		ID:        c.id,
+		Transport: TransportTCP,
+		Server:    c.server,
+		Client:    c.RemoteAddr().String(),
+		Started:   c.started.Format(time.RFC3339),
+		Age:       time.Since(c.started).Round(time.Millisecond).String(),
+		Received:  atomic.LoadUint64(&c.read),
+		Sent:      atomic.LoadUint64(&c.written),
+	}
+	if upstream, ok := c.upstream.Load().(string); ok {
+		v.Upstream = upstream
+	}
+	if state, ok := c.tlsState.Load().(tls.ConnectionState); ok {
+		v.TLS = &tlsView{
+			Version:     tlsVersions[state.Version],
+			CipherSuite: fmt.Sprintf("0x%04x", state.CipherSuite),
+			ServerName:  state.ServerName,
+			Protocol:    state.NegotiatedProtocol,
+		}
+	}
+	return v
+}
+
+// newSessionView returns the view of the UDP session p of the server at addr
+func newSessionView(addr string, p *proxyUDPConnection) connView {
+	return connView{
+		ID:        p.id,
+		Transport: TransportUDP,
+		Server:    addr,
+		Client:    p.laddr.String(),
+		Upstream:  p.Upstream(),
+		Started:   p.started.Format(time.RFC3339),
+		Age:       time.Since(p.started).Round(time.Millisecond).String(),
+		Received:  atomic.LoadUint64(&p.received),
+		Sent:      atomic.LoadUint64(&p.sent),
+		Dropped:   atomic.LoadInt64(&p.dropped),
+	}
+}
+
+// faultView is the JSON representation of a fault. Durations
+// are strings in the format of time.ParseDuration, i.e 100ms.
+type faultView struct {
+	Name        string  `json:"name"`
+	Type        string  `json:"type"`
+	Probability float64 `json:"probability"`
+	Delay       string  `json:"delay,omitempty"`
+	Jitter      string  `json:"jitter,omitempty"`
+	Rate        int64   `json:"rate,omitempty"`
+	Bytes       int64   `json:"bytes,omitempty"`
+}
+
+func newFaultView(f Fault) faultView {
+	v := faultView{
+		Name:        f.Name,
+		Type:        f.Type,
+		Probability: f.Probability,
+		Rate:        f.Rate,
+		Bytes:       f.Bytes,
+	}
+	if f.Delay > 0 {
+		v.Delay = f.Delay.String()
+	}
+	if f.Jitter > 0 {
+		v.Jitter = f.Jitter.String()
+	}
+	return v
+}
+
+func newFaultViews(faults []Fault) []faultView {
+	views := make([]faultView, 0, len(faults))
+	for _, f := range faults {
+		views = append(views, newFaultView(f))
+	}
+	return views
+}
+
+// fault validates v and returns the Fault it represents. The probability
+// defaults to 100%, except for drop faults which require it.
+func (v faultView) fault() (Fault, error) {
+	f := Fault{Name: v.Name, Type: v.Type, Probability: v.Probability, Rate: v.Rate, Bytes: v.Bytes}
+
+	if f.Probability == 0 && f.Type != FaultDrop {
+		f.Probability = 100
+	}
+	if f.Probability <= 0 || f.Probability > 100 {
+		return f, fmt.Errorf("invalid probability %g", v.Probability)
+	}
+	if strings.Contains(f.Name, "/") {
+		return f, fmt.Errorf("invalid name %s", f.Name)
+	}
+
+	var err error
+	if v.Delay != "" {
+		if f.Delay, err = time.ParseDuration(v.Delay); err != nil || f.Delay < 0 {
+			return f, fmt.Errorf("invalid delay %s", v.Delay)
+		}
+	}
+	if v.Jitter != "" {
+		if f.Jitter, err = time.ParseDuration(v.Jitter); err != nil || f.Jitter < 0 {
+			return f, fmt.Errorf("invalid jitter %s", v.Jitter)
+		}
+	}
+	if f.Rate < 0 || f.Bytes < 0 {
+		return f, fmt.Errorf("invalid size")
+	}
+
+	switch f.Type {
+	case FaultLatency, FaultReset, FaultDrop, FaultTimeout, FaultStall:
+	case FaultBandwidth:
+		if f.Rate == 0 {
+			return f, fmt.Errorf("bandwidth requires a rate")
+		}
+	case FaultPartial:
+		if f.Bytes == 0 {
+			return f, fmt.Errorf("partial requires bytes")
+		}
+	default:
+		return f, fmt.Errorf("unknown fault %s", f.Type)
+	}
+	return f, nil
+}
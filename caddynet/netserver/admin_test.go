@@ -0,0 +1,253 @@
+package netserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testAdminToken is the token of the admin servers the tests authenticate with
+const testAdminToken = "secret"
+
+// newTestAdmin returns an admin server with the token, if any, managing the
+// proxy server block :7002 which has a canary upstream group and a timeout fault
+func newTestAdmin(t *testing.T, token string) (*AdminServer, *ProxyServer) {
+	t.Helper()
+
+	c := testConfig(TransportBoth)
+	c.Type = "proxy"
+	c.ListenAddrs = []string{":7002"}
+	c.Groups = []UpstreamGroup{{Name: "canary", Percent: 10, Upstreams: []string{"127.0.0.1:9"}}}
+	c.Faults = []Fault{{Type: FaultTimeout, Probability: 100}}
+	p, err := NewProxyServer("127.0.0.1:0", "127.0.0.1:9", c)
+	if err != nil {
+		t.Fatalf("NewProxyServer: %v", err)
+	}
+
+	s := NewAdminServer("localhost:0", &Config{Type: "admin", Token: token})
+	s.blocks = []*serverBlock{{config: c, proxies: []*ProxyServer{p}}}
+	return s, p
+}
+
+// request sends a request to the admin server s, with its token if it has one
+func request(s *AdminServer, method, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if s.config.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+s.config.Token)
+	}
+	w := httptest.NewRecorder()
+	s.server.Handler.ServeHTTP(w, r)
+	return w
+}
+
+// groupWeight returns the weight of the upstream group called name of p
+func groupWeight(p *ProxyServer, name string) int32 {
+	for _, g := range p.upstreams.groups {
+		if g.name == name {
+			return atomic.LoadInt32(&g.weight)
+		}
+	}
+	return -1
+}
+
+func TestAdminGroupWeight(t *testing.T) {
+	s, p := newTestAdmin(t, testAdminToken)
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		weight             int32
+	}{
+		{http.MethodPatch, "/proxies/:7002/groups/canary", `{"weight": 50}`, http.StatusOK, 50},
+		{http.MethodPatch, "/proxies/:7002/groups/canary", `{"weight": 0}`, http.StatusOK, 0},
+		{http.MethodPatch, "/proxies/:7002/groups/canary", `{"weight": -1}`, http.StatusBadRequest, 0},
+		{http.MethodPatch, "/proxies/:7002/groups/canary", `{}`, http.StatusBadRequest, 0},
+		{http.MethodPatch, "/proxies/:7002/groups/unknown", `{"weight": 5}`, http.StatusBadRequest, 0},
+		{http.MethodPatch, "/proxies/:7003/groups/canary", `{"weight": 5}`, http.StatusNotFound, 0},
+		{http.MethodGet, "/proxies/:7002/groups/canary", "", http.StatusMethodNotAllowed, 0},
+	}
+	for _, test := range tests {
+		w := request(s, test.method, test.path, test.body)
+		if w.Code != test.code {
+			t.Errorf("%s %s %s: got %d %s, want %d", test.method, test.path, test.body, w.Code, w.Body, test.code)
+		}
+		if weight := groupWeight(p, "canary"); weight != test.weight {
+			t.Errorf("%s %s %s: weight = %d, want %d", test.method, test.path, test.body, weight, test.weight)
+		}
+	}
+}
+
+func TestAdminFaults(t *testing.T) {
+	s, p := newTestAdmin(t, testAdminToken)
+
+	tests := []struct {
+		method, path, body string
+		code               int
+		faults             int
+	}{
+		{http.MethodPost, "/proxies/:7002/faults", `{"type": "latency", "delay": "100ms"}`, http.StatusCreated, 2},
+		{http.MethodPost, "/proxies/:7002/faults", `{"type": "unknown"}`, http.StatusBadRequest, 2},
+		{http.MethodDelete, "/proxies/:7002/faults/latency", "", http.StatusNoContent, 1},
+		{http.MethodDelete, "/proxies/:7002/faults/latency", "", http.StatusNotFound, 1},
+	}
+	for _, test := range tests {
+		w := request(s, test.method, test.path, test.body)
+		if w.Code != test.code {
+			t.Errorf("%s %s %s: got %d %s, want %d", test.method, test.path, test.body, w.Code, w.Body, test.code)
+		}
+		if faults := p.faults.List(); len(faults) != test.faults {
+			t.Errorf("%s %s %s: got faults %+v, want %d", test.method, test.path, test.body, faults, test.faults)
+		}
+	}
+}
+
+func TestAdminCloseConnections(t *testing.T) {
+	s, p := newTestAdmin(t, testAdminToken)
+
+	var conns []*trackedConn
+	for i := 0; i < 3; i++ {
+		client, conn := tcpPair(t)
+		defer client.Close()
+		tc := p.conns.Add(conn)
+		defer tc.Close()
+		conns = append(conns, tc)
+	}
+
+	path := fmt.Sprintf("/connections/%d", conns[0].id)
+	if w := request(s, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE %s: got %d %s, want %d", path, w.Code, w.Body, http.StatusNoContent)
+	}
+	if _, err := conns[0].Read(make([]byte, 1)); !isClosed(err) {
+		t.Errorf("connection %d wasn't closed: %v", conns[0].id, err)
+	}
+	// the server stops tracking a connection once it's done with it
+	p.conns.Done(conns[0])
+	if w := request(s, http.MethodDelete, path, ""); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE %s again: got %d %s, want %d", path, w.Code, w.Body, http.StatusNotFound)
+	}
+
+	if w := request(s, http.MethodDelete, "/connections", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("DELETE /connections: got %d %s, want %d", w.Code, w.Body, http.StatusBadRequest)
+	}
+	w := request(s, http.MethodDelete, "/connections?ip=127.0.0.1", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"closed": 2`) {
+		t.Errorf("DELETE /connections?ip=127.0.0.1: got %d %s, want 2 closed", w.Code, w.Body)
+	}
+	for _, tc := range conns[1:] {
+		if _, err := tc.Read(make([]byte, 1)); !isClosed(err) {
+			t.Errorf("connection %d wasn't closed: %v", tc.id, err)
+		}
+	}
+}
+
+// TestAdminUDPSessions lists and closes the UDP sessions
+// of a proxy server block along with its TCP connections
+func TestAdminUDPSessions(t *testing.T) {
+	upstream, uts := startEchoServer(t, testConfig(TransportUDP))
+	defer func() {
+		upstream.Stop()
+		uts.wait(t)
+	}()
+
+	c := testConfig(TransportUDP)
+	c.Type = "proxy"
+	c.ListenAddrs = []string{":7002"}
+	p, ts := startProxyServer(t, uts.udpAddr, c)
+	defer func() {
+		p.Stop()
+		ts.wait(t)
+	}()
+	s := NewAdminServer("localhost:0", &Config{Type: "admin", Token: testAdminToken})
+	s.blocks = []*serverBlock{{config: c, proxies: []*ProxyServer{p}}}
+
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp", ts.udpAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := roundTrip(conn, []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, conn)
+	}
+
+	// the bytes sent are counted once the reply is handed to the server,
+	// which may be after the client got it
+	var views []blockConnsView
+	eventually(t, "the replies to be counted", func() bool {
+		views = nil
+		w := request(s, http.MethodGet, "/connections", "")
+		if err := json.NewDecoder(w.Body).Decode(&views); err != nil {
+			t.Fatal(err)
+		}
+		if len(views) != 1 || len(views[0].Connections) != 2 {
+			t.Fatalf("got %+v, want 2 sessions", views)
+		}
+		return views[0].Connections[0].Sent == 5 && views[0].Connections[1].Sent == 5
+	})
+	session := views[0].Connections[1]
+	if session.Transport != TransportUDP || session.Client != clients[0].LocalAddr().String() ||
+		session.Upstream != uts.udpAddr || session.Received != 5 || session.Sent != 5 {
+		t.Errorf("got %+v, want the session of %s to %s which echoed 5 bytes", session, clients[0].LocalAddr(), uts.udpAddr)
+	}
+
+	path := fmt.Sprintf("/connections/%d", session.ID)
+	if w := request(s, http.MethodDelete, path, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE %s: got %d %s, want %d", path, w.Code, w.Body, http.StatusNoContent)
+	}
+	eventually(t, "the session to close", func() bool { return p.udpClients.Len() == 1 })
+
+	w := request(s, http.MethodDelete, "/connections?ip=127.0.0.1", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"closed": 1`) {
+		t.Errorf("DELETE /connections?ip=127.0.0.1: got %d %s, want 1 closed", w.Code, w.Body)
+	}
+	eventually(t, "the sessions to close", func() bool { return p.udpClients.Len() == 0 })
+}
+
+// TestAdminChangesRequireAuthentication refuses every change
+// to an admin API without a token or a unix socket
+func TestAdminChangesRequireAuthentication(t *testing.T) {
+	s, p := newTestAdmin(t, "")
+	client, conn := tcpPair(t)
+	defer client.Close()
+	tc := p.conns.Add(conn)
+	defer tc.Close()
+
+	tests := []struct {
+		method, path, body string
+	}{
+		{http.MethodPost, "/proxies/:7002/upstreams", `{"address": "127.0.0.1:10"}`},
+		{http.MethodPatch, "/proxies/:7002/upstreams", `{"address": "127.0.0.1:9", "drained": true}`},
+		{http.MethodDelete, "/proxies/:7002/upstreams?address=127.0.0.1:9", ""},
+		{http.MethodPatch, "/proxies/:7002/groups/canary", `{"weight": 50}`},
+		{http.MethodPost, "/proxies/:7002/faults", `{"type": "latency", "delay": "100ms"}`},
+		{http.MethodDelete, "/proxies/:7002/faults/timeout", ""},
+		{http.MethodDelete, "/connections?ip=127.0.0.1", ""},
+		{http.MethodDelete, fmt.Sprintf("/connections/%d", tc.id), ""},
+	}
+	for _, test := range tests {
+		if w := request(s, test.method, test.path, test.body); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: got %d %s, want %d", test.method, test.path, w.Code, w.Body, http.StatusForbidden)
+		}
+	}
+
+	if weight := groupWeight(p, "canary"); weight != 10 {
+		t.Errorf("weight = %d, want 10", weight)
+	}
+	if views := p.upstreams.groups[0].pool.views(); len(views) != 1 || views[0].Drained {
+		t.Errorf("got upstreams %+v, want 127.0.0.1:9 undrained", views)
+	}
+	if faults := p.faults.List(); len(faults) != 1 || faults[0].Name != FaultTimeout {
+		t.Errorf("got faults %+v, want the timeout fault only", faults)
+	}
+	if n := p.conns.Len(); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
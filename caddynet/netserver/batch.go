@@ -0,0 +1,81 @@
+package netserver
+
+import (
+	"net"
+	"sync"
+)
+
+// udpBufferSize is the size of the buffers datagrams
+// from upstream servers are read into
+const udpBufferSize = 32 * 1024
+
+var udpBufferPool = sync.Pool{
+	New: func() interface{} { return make([]byte, udpBufferSize) },
+}
+
+// getUDPBuffer returns a buffer from the pool
+func getUDPBuffer() []byte {
+	return udpBufferPool.Get().([]byte)
+}
+
+// putUDPBuffer returns buf to the pool
+func putUDPBuffer(buf []byte) {
+	udpBufferPool.Put(buf[:cap(buf)])
+}
+
+// datagram is a datagram read from or written to a packet connection
+type datagram struct {
+	buf  []byte // buffer the datagram is read into or written from
+	n    int    // length of the datagram in buf
+	addr net.Addr
+
+	// local is the address the datagram was sent to when it's read, and the
+	// address it's sent from when it's written. It's only known for listeners
+	// bound to a wildcard address on platforms that support it, and nil otherwise.
+	local net.IP
+}
+
+// batchConn reads and writes datagrams in batches. Reads and writes may
+// happen concurrently, but not multiple reads or multiple writes.
+type batchConn interface {
+	// ReadBatch blocks until at least one datagram is read into ds,
+	// and returns the number of datagrams read
+	ReadBatch(ds []datagram) (int, error)
+
+	// WriteBatch writes the datagrams in ds and
+	// returns the number of datagrams written
+	WriteBatch(ds []datagram) (int, error)
+}
+
+// newDatagrams returns n datagrams with a buffer of size bytes each
+func newDatagrams(n, size int) []datagram {
+	ds := make([]datagram, n)
+	for i := range ds {
+		ds[i].buf = make([]byte, size)
+	}
+	return ds
+}
+
+// singleConn is a batchConn that reads a single datagram per
+// call and writes the datagrams of a batch one after the other
+type singleConn struct {
+	conn net.PacketConn
+}
+
+func (c *singleConn) ReadBatch(ds []datagram) (int, error) {
+	n, addr, err := c.conn.ReadFrom(ds[0].buf)
+	if err != nil {
+		return 0, err
+	}
+	ds[0].n, ds[0].addr, ds[0].local = n, addr, nil
+	return 1, nil
+}
+
+func (c *singleConn) WriteBatch(ds []datagram) (int, error) {
+	for i, d := range ds {
+		if _, err := c.conn.WriteTo(d.buf[:d.n], d.addr); err != nil {
+			return i, err
+		}
+	}
+	return len(ds), nil
+}
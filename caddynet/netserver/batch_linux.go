@@ -0,0 +1,158 @@
+//go:build linux
+// +build linux
+
+package netserver
+
+import (
+	"io"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// mmsgConn is a batchConn that reads and writes batches of datagrams
+// with a single recvmmsg or sendmmsg system call
+type mmsgConn struct {
+	readBatch  func(ms []ipv4.Message, flags int) (int, error)
+	writeBatch func(ms []ipv4.Message, flags int) (int, error)
+	rmsgs      []ipv4.Message
+	wmsgs      []ipv4.Message
+
+	// parseDst returns the destination address of a datagram from the control
+	// messages it was read with. It's only set for wildcard listeners, which
+	// have to reply from the address the client sent its datagram to.
+	parseDst func(oob []byte) net.IP
+}
+
+// newBatchConn returns a batchConn for conn which
+// reads and writes up to size datagrams at once
+func newBatchConn(conn net.PacketConn, size int) batchConn {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return &singleConn{conn: conn}
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	c := &mmsgConn{
+		rmsgs: make([]ipv4.Message, size),
+		wmsgs: make([]ipv4.Message, size),
+	}
+
+	// ipv4.Message and ipv6.Message are the same type
+	laddr, _ := udpConn.LocalAddr().(*net.UDPAddr)
+	if laddr != nil && laddr.IP.To4() != nil {
+		p := ipv4.NewPacketConn(udpConn)
+		c.readBatch, c.writeBatch = p.ReadBatch, p.WriteBatch
+	} else {
+		p := ipv6.NewPacketConn(udpConn)
+		c.readBatch, c.writeBatch = p.ReadBatch, p.WriteBatch
+	}
+
+	if laddr != nil && laddr.IP.IsUnspecified() {
+		c.enablePacketInfo(udpConn)
+	}
+
+	return c
+}
+
+// enablePacketInfo makes the kernel pass the destination address of each
+// datagram read from conn. A listener on 0.0.0.0 or [::] is usually an IPv6
+// socket that receives IPv4 datagrams as well, so IPV6_RECVPKTINFO is tried
+// first and IP_PKTINFO is used for IPv4 only sockets.
+func (c *mmsgConn) enablePacketInfo(conn *net.UDPConn) {
+	var oob []byte
+	if ipv6.NewPacketConn(conn).SetControlMessage(ipv6.FlagDst, true) == nil {
+		c.parseDst, oob = parseDst6, ipv6.NewControlMessage(ipv6.FlagDst)
+	} else if ipv4.NewPacketConn(conn).SetControlMessage(ipv4.FlagDst, true) == nil {
+		c.parseDst, oob = parseDst4, ipv4.NewControlMessage(ipv4.FlagDst)
+	} else {
+		return
+	}
+
+	for i := range c.rmsgs {
+		c.rmsgs[i].OOB = make([]byte, len(oob))
+	}
+}
+
+func parseDst4(oob []byte) net.IP {
+	var cm ipv4.ControlMessage
+	if cm.Parse(oob) != nil {
+		return nil
+	}
+	return cm.Dst
+}
+
+func parseDst6(oob []byte) net.IP {
+	var cm ipv6.ControlMessage
+	if cm.Parse(oob) != nil {
+		return nil
+	}
+	return cm.Dst
+}
+
+// marshalSrc returns the control message which sends a datagram from src.
+// IPv4 datagrams need IP_PKTINFO, even when they're sent by an IPv6 socket.
+func marshalSrc(src net.IP) []byte {
+	if src.To4() != nil {
+		cm := ipv4.ControlMessage{Src: src}
+		return cm.Marshal()
+	}
+	cm := ipv6.ControlMessage{Src: src}
+	return cm.Marshal()
+}
+
+func (c *mmsgConn) ReadBatch(ds []datagram) (int, error) {
+	ms := c.rmsgs[:minInt(len(ds), len(c.rmsgs))]
+	for i := range ms {
+		ms[i].Buffers = [][]byte{ds[i].buf}
+	}
+
+	n, err := c.readBatch(ms, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		ds[i].n, ds[i].addr, ds[i].local = ms[i].N, ms[i].Addr, nil
+		if c.parseDst != nil && ms[i].NN > 0 {
+			ds[i].local = c.parseDst(ms[i].OOB[:ms[i].NN])
+		}
+	}
+	return n, nil
+}
+
+func (c *mmsgConn) WriteBatch(ds []datagram) (int, error) {
+	written := 0
+	for written < len(ds) {
+		ms := c.wmsgs[:minInt(len(ds)-written, len(c.wmsgs))]
+		for i := range ms {
+			d := ds[written+i]
+			ms[i].Buffers = [][]byte{d.buf[:d.n]}
+			ms[i].Addr = d.addr
+			ms[i].OOB = nil
+			if d.local != nil {
+				ms[i].OOB = marshalSrc(d.local)
+			}
+		}
+
+		n, err := c.writeBatch(ms, 0)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package netserver
+
+import "net"
+
+// newBatchConn returns a batchConn for conn. Batching isn't
+// supported on this platform, datagrams are read one at a time.
+func newBatchConn(conn net.PacketConn, size int) batchConn {
+	return &singleConn{conn: conn}
+}
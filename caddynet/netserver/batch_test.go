@@ -0,0 +1,85 @@
+package netserver
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// benchmarkDatagramSize is the size of the datagrams the benchmarks read,
+// about that of a DNS query
+const benchmarkDatagramSize = 64
+
+// benchmarkRound is the number of datagrams queued at a time, few
+// enough to fit in the socket buffer so that none of them are dropped
+const benchmarkRound = 64
+
+// benchmarkRead runs read on a UDP listener of the loopback interface
+// until it has read b.N datagrams. The datagrams are queued in rounds
+// with the timer stopped, so that only the reads are measured.
+// read returns the number of datagrams it read.
+func benchmarkRead(b *testing.B, read func(conn net.PacketConn) (int, error)) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sender.Close()
+
+	msg := make([]byte, benchmarkDatagramSize)
+	b.SetBytes(benchmarkDatagramSize)
+	b.ResetTimer()
+	for n := 0; n < b.N; {
+		b.StopTimer()
+		round := benchmarkRound
+		if b.N-n < round {
+			round = b.N - n
+		}
+		for i := 0; i < round; i++ {
+			if _, err := sender.Write(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		b.StartTimer()
+
+		for queued := round; queued > 0; {
+			read, err := read(conn)
+			if err != nil {
+				b.Fatal(err)
+			}
+			queued -= read
+		}
+		n += round
+	}
+}
+
+// BenchmarkReadBatch reads datagrams the way the UDP servers do,
+// in batches of DefaultUDPBatchSize where the platform supports it
+func BenchmarkReadBatch(b *testing.B) {
+	var bc batchConn
+	ds := newDatagrams(DefaultUDPBatchSize, DefaultUDPMaxDatagramSize)
+	benchmarkRead(b, func(conn net.PacketConn) (int, error) {
+		if bc == nil {
+			bc = newBatchConn(conn, DefaultUDPBatchSize)
+		}
+		return bc.ReadBatch(ds)
+	})
+}
+
+// BenchmarkReadFromLoop reads datagrams one at a time
+// with ReadFrom, which is what ReadBatch is compared to
+func BenchmarkReadFromLoop(b *testing.B) {
+	buf := make([]byte, DefaultUDPMaxDatagramSize)
+	benchmarkRead(b, func(conn net.PacketConn) (int, error) {
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			return 0, err
+		}
+		return 1, nil
+	})
+}
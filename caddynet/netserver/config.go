@@ -1,6 +1,54 @@
 package netserver
 
-import "github.com/caddyserver/caddy/caddytls"
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/caddytls"
+)
+
+// Transports a server block can listen on
+const (
+	TransportTCP  = "tcp"
+	TransportUDP  = "udp"
+	TransportBoth = "both"
+)
+
+// Defaults for UDP proxy sessions and echo workers
+const (
+	DefaultUDPIdleTimeout     = 60 * time.Second
+	DefaultUDPMaxSessions     = 10000
+	DefaultUDPQueueSize       = 128
+	DefaultUDPBatchSize       = 32
+	DefaultUDPWorkers         = 8
+	DefaultUDPMaxDatagramSize = 4096
+)
+
+// UDPConfig contains the settings for proxying UDP
+type UDPConfig struct {
+	// Time after which a session without traffic is closed
+	IdleTimeout time.Duration
+
+	// Maximum number of concurrent sessions, when reached the
+	// least recently used session is closed for a new client
+	MaxSessions int
+
+	// Number of datagrams queued per session for the upstream,
+	// datagrams that don't fit in the queue are dropped
+	QueueSize int
+
+	// Maximum number of datagrams read or written with a single
+	// system call, where supported
+	BatchSize int
+
+	// Number of goroutines of an echo server block that read
+	// datagrams from the listener and write them back
+	Workers int
+
+	// Size of the buffers datagrams from clients are read into,
+	// the rest of larger datagrams is discarded
+	MaxDatagramSize int
+}
 
 // Config contains configuration details about a net server type
 type Config struct {
@@ -12,9 +60,72 @@ type Config struct {
 	// The port the server binds to and listens on
 	ListenPort string
 
+	// The addresses the server block listens on, port ranges not yet expanded
+	ListenAddrs []string
+
+	// The address a proxy server block forwards traffic to
+	DestAddr string
+
+	// Additional addresses a proxy server block balances traffic across
+	Upstreams []string
+
+	// Weights of upstream addresses, upstreams not in it have a weight of 1
+	Weights map[string]int
+
+	// Named groups of upstreams that get a share of the traffic,
+	// the remaining traffic goes to the default group
+	Groups []UpstreamGroup
+
+	// Addresses a proxy server block copies every UDP datagram to,
+	// their replies are ignored
+	Fanout []string
+
+	// The transport(s) the server listens on: tcp, udp or both
+	Transport string
+
 	// TLS configuration
 	TLS *caddytls.Config
 
+	// Settings for dialing upstream servers
+	Dial DialConfig
+
+	// Socket options of the listeners and upstream connections
+	Socket SocketConfig
+
+	// Settings for looking up upstream hostnames
+	Resolver ResolverConfig
+
+	// Settings for proxying UDP
+	UDP UDPConfig
+
+	// Settings for active health checks of upstreams
+	HealthCheck HealthCheckConfig
+
+	// Settings for shadowing TCP traffic to another upstream
+	Mirror MirrorConfig
+
+	// Settings for keeping idle upstream connections ready
+	Prewarm PrewarmConfig
+
+	// Faults injected into the proxied traffic
+	Faults []Fault
+
+	// Token clients of an admin server block must send, if set
+	Token string
+
+	// Time live connections get to finish when the server is
+	// stopped, after which they are closed
+	GracePeriod time.Duration
+
+	// resolver is shared by all servers of the server block
+	resolver *resolver
+
+	// faults are shared by all servers of the server block
+	faults *faultSet
+
+	// instance is shared by all servers of the Caddy instance
+	instance *instanceState
+
 	Parameters []string
 	Tokens     map[string][]string
 }
@@ -33,3 +144,30 @@ func (c Config) Host() string {
 func (c Config) Port() string {
 	return c.ListenPort
 }
+
+// ServesTCP returns true if a TCP listener should be started
+func (c Config) ServesTCP() bool {
+	return c.Transport != TransportUDP
+}
+
+// ServesUDP returns true if a UDP packet connection should be started
+func (c Config) ServesUDP() bool {
+	return c.Transport != TransportTCP
+}
+
+// restarting returns true if the Caddy instance the
+// server block belongs to is being replaced by a reload
+func (c *Config) restarting() bool {
+	return c.instance != nil && atomic.LoadInt32(&c.instance.restarting) == 1
+}
+
+// drainDeadline returns when the connections still open on a stopped server
+// of the block are closed. Caddy stops the servers of an instance one after
+// another, so their grace periods all start when the first one is stopped,
+// rather than adding up for i.e. a port range.
+func (c *Config) drainDeadline() time.Time {
+	if c.instance == nil {
+		return time.Now().Add(c.GracePeriod)
+	}
+	return c.instance.stopping().Add(c.GracePeriod)
+}
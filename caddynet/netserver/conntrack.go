@@ -0,0 +1,193 @@
+package netserver
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultGracePeriod is the time live connections get
+// to finish on their own when a server is stopped
+const DefaultGracePeriod = 5 * time.Second
+
+// drainPollInterval is how often a draining server
+// checks whether its connections have finished
+const drainPollInterval = 50 * time.Millisecond
+
+// lastConnID is the ID of the last connection
+// accepted by any server, accessed atomically
+var lastConnID uint64
+
+// trackedConn is a live connection of a server. It counts the
+// bytes read from and written to the client, and keeps what is
+// known about the connection for the admin API.
+type trackedConn struct {
+	net.Conn
+	id       uint64
+	server   string
+	started  time.Time
+	read     uint64       // accessed atomically
+	written  uint64       // accessed atomically
+	upstream atomic.Value // string, the address of the upstream once dialed
+	tlsState atomic.Value // tls.ConnectionState, once the handshake completed
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddUint64(&c.read, uint64(n))
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+// Handshake runs the TLS handshake of c, if it's a TLS connection,
+// and keeps the state of the connection once it's done
+func (c *trackedConn) Handshake() error {
+	tc, ok := c.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tc.Handshake(); err != nil {
+		return err
+	}
+	c.tlsState.Store(tc.ConnectionState())
+	return nil
+}
+
+// SetUpstream records the address of the upstream c is proxied to
+func (c *trackedConn) SetUpstream(addr string) {
+	c.upstream.Store(addr)
+}
+
+// connTracker keeps track of the live connections of a server, so that
+// they can be drained when it's stopped and managed by the admin API
+type connTracker struct {
+	server string
+
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+// newConnTracker returns an empty connTracker for the server at addr
+func newConnTracker(addr string) *connTracker {
+	return &connTracker{server: addr, conns: make(map[*trackedConn]struct{})}
+}
+
+// Add tracks c until Done is called for the returned
+// connection, which should be used instead of c
+func (t *connTracker) Add(c net.Conn) *trackedConn {
+	tc := &trackedConn{
+		Conn:    c,
+		id:      atomic.AddUint64(&lastConnID, 1),
+		server:  t.server,
+		started: time.Now(),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.conns[tc] = struct{}{}
+	return tc
+}
+
+// Done stops tracking c once it has finished
+func (t *connTracker) Done(c *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.conns, c)
+}
+
+// Len returns the number of live connections
+func (t *connTracker) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return len(t.conns)
+}
+
+// List returns the live connections, oldest first
+func (t *connTracker) List() []*trackedConn {
+	t.mu.Lock()
+	conns := make([]*trackedConn, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	t.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+	return conns
+}
+
+// Close closes the connection with id, and returns false if there is none
+func (t *connTracker) Close(id uint64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.conns {
+		if c.id == id {
+			c.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// CloseFrom closes the connections from the client IP ip
+// and returns how many there were
+func (t *connTracker) CloseFrom(ip net.IP) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := 0
+	for c := range t.conns {
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && addr.IP.Equal(ip) {
+			c.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// Drain waits until deadline for the live connections to finish, then
+// closes the connections that are left and returns how many there were
+func (t *connTracker) Drain(deadline time.Time) int {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for t.Len() > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for c := range t.conns {
+		c.Close()
+	}
+	return len(t.conns)
+}
+
+// drain drains the connections of the server at addr until deadline,
+// logging how many connections are draining and how many had to be closed
+func drain(addr string, conns *connTracker, deadline time.Time) {
+	n := conns.Len()
+	if n == 0 {
+		return
+	}
+
+	log.Printf("[INFO] Draining %d connections of %s", n, addr)
+	if closed := conns.Drain(deadline); closed > 0 {
+		log.Printf("[WARNING] Closed %d connections of %s that were still open at the end of the grace period", closed, addr)
+	} else {
+		log.Printf("[INFO] Drained the connections of %s", addr)
+	}
+}
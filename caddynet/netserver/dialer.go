@@ -0,0 +1,271 @@
+package netserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Address families for upstream dials
+const (
+	FamilyAny        = "any"
+	FamilyIPv4       = "ipv4"
+	FamilyIPv6       = "ipv6"
+	FamilyPreferIPv4 = "prefer_ipv4"
+	FamilyPreferIPv6 = "prefer_ipv6"
+)
+
+// defaultFallbackDelay is the delay between connection attempts to the
+// resolved addresses of an upstream, as recommended by RFC 8305
+const defaultFallbackDelay = 250 * time.Millisecond
+
+// DialConfig contains the settings used to dial upstream servers
+type DialConfig struct {
+	// Local IP address upstream connections originate from
+	Source net.IP
+
+	// Address family to use: any, ipv4, ipv6, prefer_ipv4 or prefer_ipv6
+	Family string
+
+	// Delay before the next resolved address is tried while
+	// earlier attempts are still in progress (Happy Eyeballs)
+	FallbackDelay time.Duration
+
+	// Timeout for a complete dial, including all attempts
+	Timeout time.Duration
+}
+
+// upstreamDialer dials upstream servers according to a DialConfig
+type upstreamDialer struct {
+	config   DialConfig
+	socket   SocketConfig
+	resolver *resolver
+}
+
+// endpoint is a resolved upstream address
+type endpoint struct {
+	ip   net.IP
+	port string
+}
+
+func (e endpoint) String() string {
+	return net.JoinHostPort(e.ip.String(), e.port)
+}
+
+// newUpstreamDialer returns a dialer for the upstream settings in c
+// which sets the socket options sock and looks up upstream hostnames using r
+func newUpstreamDialer(c DialConfig, sock SocketConfig, r *resolver) *upstreamDialer {
+	if c.Family == "" {
+		c.Family = FamilyAny
+	}
+	if c.FallbackDelay == 0 {
+		c.FallbackDelay = defaultFallbackDelay
+	}
+	return &upstreamDialer{config: c, socket: sock, resolver: r}
+}
+
+// DialTCP connects to one of addrs. All addresses the upstreams resolve
+// to are raced Happy Eyeballs style: a new attempt starts every
+// FallbackDelay until one of them succeeds. The upstreams are tried in
+// the order of addrs, so that the upstream the pool picked comes first.
+func (d *upstreamDialer) DialTCP(ctx context.Context, addrs []string) (net.Conn, error) {
+	if d.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.config.Timeout)
+		defer cancel()
+	}
+
+	endpoints, err := d.resolve(ctx, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult, len(endpoints))
+	dial := func(e endpoint) {
+		dialer := d.socket.Dialer()
+		if d.config.Source != nil {
+			dialer.LocalAddr = &net.TCPAddr{IP: d.config.Source}
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", e.String())
+		if err == nil {
+			d.socket.Apply(conn)
+		}
+		results <- dialResult{conn, err}
+	}
+
+	var firstErr error
+	next, pending := 0, 0
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if next < len(endpoints) {
+				go dial(endpoints[next])
+				next++
+				pending++
+				timer.Reset(d.config.FallbackDelay)
+			}
+
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections of attempts that lost the race
+				go func(n int) {
+					for ; n > 0; n-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next == len(endpoints) && pending == 0 {
+				return nil, firstErr
+			}
+			// don't wait for the fallback delay if an attempt failed
+			if next < len(endpoints) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			}
+		}
+	}
+}
+
+// DialUDP connects to the first address of addrs, which is the upstream
+// the pool picked, using the preferred address family of its IPs. The
+// other addresses aren't tried, as a UDP dial can't tell whether the
+// upstream is up.
+func (d *upstreamDialer) DialUDP(ctx context.Context, addrs []string) (*net.UDPConn, error) {
+	if len(addrs) > 1 {
+		addrs = addrs[:1]
+	}
+	endpoints, err := d.resolve(ctx, addrs)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := d.socket.Dialer()
+	if d.config.Source != nil {
+		dialer.LocalAddr = &net.UDPAddr{IP: d.config.Source}
+	}
+
+	conn, err := dialer.DialContext(ctx, "udp", endpoints[0].String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// resolve looks up the hosts of addrs and returns the endpoints that can be
+// dialed. The endpoints of each upstream are ordered by the preferred address
+// family, and the upstreams keep the order of addrs.
+func (d *upstreamDialer) resolve(ctx context.Context, addrs []string) ([]endpoint, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no upstream addresses available")
+	}
+
+	var endpoints []endpoint
+	var firstErr error
+	resolved := false
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, _, err := d.resolver.LookupIP(ctx, host)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		resolved = true
+
+		upstream := make([]endpoint, 0, len(ips))
+		for _, ip := range ips {
+			upstream = append(upstream, endpoint{ip: ip, port: port})
+		}
+		endpoints = append(endpoints, sortByFamily(upstream, d.config.Family, d.config.Source)...)
+	}
+
+	if len(endpoints) == 0 {
+		if !resolved {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("no %s address found for %s", d.config.Family, strings.Join(addrs, ", "))
+	}
+
+	return endpoints, nil
+}
+
+// sortByFamily filters the endpoints of an upstream by the given address family
+// and the family of source, if set, and interleaves the remaining endpoints
+// starting with the preferred family as described in RFC 8305
+func sortByFamily(endpoints []endpoint, family string, source net.IP) []endpoint {
+	var v4, v6 []endpoint
+	for _, e := range endpoints {
+		if e.ip.To4() != nil {
+			v4 = append(v4, e)
+		} else {
+			v6 = append(v6, e)
+		}
+	}
+
+	if source != nil {
+		if source.To4() != nil {
+			v6 = nil
+		} else {
+			v4 = nil
+		}
+	}
+
+	first, second := v6, v4
+	switch family {
+	case FamilyIPv4:
+		first, second = v4, nil
+	case FamilyIPv6:
+		first, second = v6, nil
+	case FamilyPreferIPv4:
+		first, second = v4, v6
+	case FamilyPreferIPv6:
+		first, second = v6, v4
+	default:
+		// keep the order of the first resolved address
+		if len(endpoints) > 0 && endpoints[0].ip.To4() != nil {
+			first, second = v4, v6
+		}
+	}
+
+	sorted := make([]endpoint, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+
+	return sorted
+}
@@ -0,0 +1,73 @@
+package netserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// TestResolveUpstreamOrder applies the address family to the addresses
+// of each upstream, without reordering the upstreams
+func TestResolveUpstreamOrder(t *testing.T) {
+	s := startDNSServer(t,
+		"both.test. 60 IN A 10.0.0.2",
+		"both.test. 60 IN AAAA fd00::2",
+	)
+	defer s.Close()
+	addrs := []string{"10.0.0.1:80", "[fd00::1]:80", "both.test:80"}
+
+	tests := []struct {
+		family string
+		want   []string
+	}{
+		{FamilyAny, []string{"10.0.0.1:80", "[fd00::1]:80", "10.0.0.2:80", "[fd00::2]:80"}},
+		{FamilyPreferIPv4, []string{"10.0.0.1:80", "[fd00::1]:80", "10.0.0.2:80", "[fd00::2]:80"}},
+		{FamilyPreferIPv6, []string{"10.0.0.1:80", "[fd00::1]:80", "[fd00::2]:80", "10.0.0.2:80"}},
+		{FamilyIPv4, []string{"10.0.0.1:80", "10.0.0.2:80"}},
+		{FamilyIPv6, []string{"[fd00::1]:80", "[fd00::2]:80"}},
+	}
+	for _, test := range tests {
+		r := newResolver(ResolverConfig{Servers: []string{s.addr}})
+		d := newUpstreamDialer(DialConfig{Family: test.family}, SocketConfig{}, r)
+		endpoints, err := d.resolve(context.Background(), addrs)
+		if err != nil {
+			t.Fatalf("%s: %v", test.family, err)
+		}
+		got := make([]string, 0, len(endpoints))
+		for _, e := range endpoints {
+			got = append(got, e.String())
+		}
+		if strings.Join(got, " ") != strings.Join(test.want, " ") {
+			t.Errorf("%s: got %v, want %v", test.family, got, test.want)
+		}
+	}
+}
+
+// TestDialUDPPickedUpstream dials the upstream the pool picked,
+// even if another upstream has an address of the preferred family
+func TestDialUDPPickedUpstream(t *testing.T) {
+	for _, family := range []string{FamilyAny, FamilyPreferIPv4, FamilyPreferIPv6} {
+		d := newUpstreamDialer(DialConfig{Family: family}, SocketConfig{}, newResolver(ResolverConfig{}))
+		for _, addrs := range [][]string{
+			{"127.0.0.1:5353", "[::1]:5353"},
+			{"127.0.0.2:5353", "127.0.0.1:5353"},
+		} {
+			conn, err := d.DialUDP(context.Background(), addrs)
+			if err != nil {
+				t.Fatalf("%s %v: %v", family, addrs, err)
+			}
+			conn.Close()
+			if got := conn.RemoteAddr().String(); got != addrs[0] {
+				t.Errorf("%s %v: dialed %s, want %s", family, addrs, got, addrs[0])
+			}
+		}
+	}
+}
+
+func TestDialUDPFamily(t *testing.T) {
+	d := newUpstreamDialer(DialConfig{Family: FamilyIPv6}, SocketConfig{}, newResolver(ResolverConfig{}))
+	if conn, err := d.DialUDP(context.Background(), []string{"127.0.0.1:5353", "[::1]:5353"}); err == nil {
+		conn.Close()
+		t.Errorf("dialed %s, want no ipv6 address of the picked upstream", conn.RemoteAddr())
+	}
+}
@@ -2,6 +2,7 @@ package netserver
 
 import (
 	"crypto/tls"
+	"expvar"
 	"fmt"
 	"io"
 	"net"
@@ -11,47 +12,58 @@ import (
 )
 
 // EchoServer is an echo implementation of the
-// caddy.Server interface type
+// caddy.GracefulServer interface type
 type EchoServer struct {
 	LocalTCPAddr string
-	tcpListener  net.Listener
-	udpListener  net.PacketConn
-	udpSemaphore chan int
+	listeners    serverListeners
 	config       *Config
+	tlsConfig    *tls.Config
+	conns        *connTracker
+	metrics      *expvar.Map
 }
 
 // NewEchoServer returns a new echo server
 func NewEchoServer(l string, c *Config) (*EchoServer, error) {
-	return &EchoServer{
+	tlsConfig, err := caddytls.MakeTLSConfig([]*caddytls.Config{c.TLS})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &EchoServer{
 		LocalTCPAddr: l,
-		udpSemaphore: make(chan int, 100),
 		config:       c,
-	}, nil
+		tlsConfig:    tlsConfig,
+		conns:        newConnTracker(serverAddress(l, c)),
+		metrics:      newServerMetrics("echo " + serverAddress(l, c)),
+	}
+	s.metrics.Set("connections_active", expvar.Func(func() interface{} { return s.conns.Len() }))
+
+	return s, nil
+}
+
+// Address returns the address s listens on. It's prefixed with the
+// transport if s only listens on one, i.e. udp/:7.
+func (s *EchoServer) Address() string {
+	return serverAddress(s.LocalTCPAddr, s.config)
+}
+
+// WrapListener returns ln as is, as echo servers
+// don't have listener middleware
+func (s *EchoServer) WrapListener(ln net.Listener) net.Listener {
+	return ln
 }
 
 // Listen starts listening by creating a new listener
 // and returning it. It does not start accepting
 // connections.
 func (s *EchoServer) Listen() (net.Listener, error) {
-	var listener net.Listener
-
-	tlsConfig, err := caddytls.MakeTLSConfig([]*caddytls.Config{s.config.TLS})
-	if err != nil {
-		return nil, err
+	if !s.config.ServesTCP() {
+		return nil, nil
 	}
 
-	inner, err := net.Listen("tcp", fmt.Sprintf("%s", s.LocalTCPAddr))
-	if err != nil {
-		return nil, err
-	}
-
-	if tlsConfig != nil {
-		listener = tls.NewListener(inner, tlsConfig)
-	} else {
-		listener = inner
-	}
-
-	return listener, nil
+	// TLS is added by Serve, so that the listener
+	// can be handed over to a new instance on a reload
+	return s.config.Socket.Listen(s.LocalTCPAddr)
 
 }
 
@@ -59,7 +71,11 @@ func (s *EchoServer) Listen() (net.Listener, error) {
 // and returning it. It does not start accepting
 // connections.
 func (s *EchoServer) ListenPacket() (net.PacketConn, error) {
-	return net.ListenPacket("udp", fmt.Sprintf("%s", s.LocalTCPAddr))
+	if !s.config.ServesUDP() {
+		return nil, nil
+	}
+
+	return s.config.Socket.ListenPacket(s.LocalTCPAddr)
 
 }
 
@@ -67,76 +83,128 @@ func (s *EchoServer) ListenPacket() (net.PacketConn, error) {
 // Serve blocks indefinitely, or in other
 // words, until the server is stopped.
 func (s *EchoServer) Serve(ln net.Listener) error {
+	if ln == nil {
+		return nil
+	}
+
+	lns := s.config.Socket.listeners(ln, s.LocalTCPAddr, s.tlsConfig)
+	if !s.listeners.SetTCP(lns) {
+		// s was stopped before it started serving
+		return nil
+	}
 
-	s.tcpListener = ln
+	return acceptLoops(lns, s.handle, s.metrics)
+}
 
-	for {
-		conn, err := ln.Accept()
+// handle echoes a connection accepted by Serve
+func (s *EchoServer) handle(conn net.Conn) {
+	go func(c *trackedConn) {
+		defer s.conns.Done(c)
+
+		// Echo all incoming data.
+		err := c.Handshake()
+		if err == nil {
+			_, err = io.Copy(c, c)
+		}
 		if err != nil {
-			return err
+			fmt.Printf("io.Copy error: %v\n", err)
 		}
 
-		go func(c net.Conn) {
-			// Echo all incoming data.
-			_, err := io.Copy(c, c)
-			if err != nil {
-				fmt.Printf("io.Copy error: %v\n", err)
-			}
-
-			// Shut down the connection.
-			c.Close()
-		}(conn)
-	}
+		// Shut down the connection.
+		c.Close()
+	}(s.conns.Add(conn))
 }
 
 // ServePacket starts serving using the provided listener.
 // ServePacket blocks indefinitely, or in other
 // words, until the server is stopped.
 func (s *EchoServer) ServePacket(con net.PacketConn) error {
+	if con == nil {
+		return nil
+	}
 
-	s.udpListener = con
+	if !s.listeners.SetUDP(con) {
+		return nil
+	}
 
-	for {
-		s.udpSemaphore <- 1 //semaphore
-		go s.echoUDP(con)
+	// a fixed number of workers share the listener, closing it
+	// ends them all and ServePacket returns once they have returned
+	workers := s.config.UDP.Workers
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- s.echoUDP(con)
+		}()
 	}
 
+	var err error
+	for i := 0; i < workers; i++ {
+		if werr := <-errs; err == nil {
+			err = werr
+		}
+	}
+	return err
 }
 
-func (s *EchoServer) echoUDP(con net.PacketConn) {
-	defer func() { <-s.udpSemaphore }()
+// echoUDP reads batches of datagrams from con and writes them back until
+// con is closed. Other errors are counted and retried after a delay.
+func (s *EchoServer) echoUDP(con net.PacketConn) error {
+	bc := newBatchConn(con, s.config.UDP.BatchSize)
+	ds := newDatagrams(s.config.UDP.BatchSize, s.config.UDP.MaxDatagramSize)
 
-	buf := make([]byte, 4096)
-	nr, addr, err := con.ReadFrom(buf)
-	if err != nil {
-		s.udpListener.Close()
-	}
-	_, err = con.WriteTo(buf[:nr], addr)
-	if err != nil {
-		s.udpListener.Close()
+	var retry retryDelay
+	for {
+		n, err := bc.ReadBatch(ds)
+		if err != nil {
+			if isClosed(err) {
+				return err
+			}
+			s.metrics.Add("udp_read_errors", 1)
+			retry.Wait(err, "Reading datagrams on %s", s.LocalTCPAddr)
+			continue
+		}
+		retry.Reset()
+
+		// datagrams without an address can't be echoed, the others are moved
+		// to the front, swapping the buffers so that none are shared
+		m := 0
+		for i, d := range ds[:n] {
+			if d.addr == nil {
+				s.metrics.Add("udp_read_errors", 1)
+				continue
+			}
+			ds[m], ds[i] = ds[i], ds[m]
+			m++
+		}
+
+		written, err := bc.WriteBatch(ds[:m])
+		s.metrics.Add("udp_datagrams_echoed", int64(written))
+		if err != nil {
+			s.metrics.Add("udp_write_errors", int64(m-written))
+		}
 	}
 }
 
-// Stop stops s gracefully and closes its listener.
+// Stop stops s gracefully: it closes its listeners and waits for the
+// live connections to finish, up to the grace period, before closing them.
 func (s *EchoServer) Stop() error {
+	err := s.listeners.Close()
 
-	err := s.tcpListener.Close()
-	if err != nil {
-		return err
-	}
-
-	err = s.udpListener.Close()
-	if err != nil {
-		return err
+	if s.config.restarting() {
+		// the listeners have been handed over to the new instance,
+		// the connections of this one finish in the background
+		go drain(s.Address(), s.conns, s.config.drainDeadline())
+	} else {
+		drain(s.Address(), s.conns, s.config.drainDeadline())
 	}
 
-	return nil
+	return err
 }
 
 // OnStartupComplete lists the sites served by this server
 // and any relevant information
 func (s *EchoServer) OnStartupComplete() {
 	if !caddy.Quiet {
-		fmt.Println("[INFO] Echoing on port ", s.LocalTCPAddr)
+		fmt.Printf("[INFO] Echoing on %s (%s)\n", s.LocalTCPAddr, s.config.Transport)
 	}
 }
@@ -0,0 +1,262 @@
+package netserver
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTimeout bounds every wait of the tests, so that a hang fails the test
+const testTimeout = 5 * time.Second
+
+// testConfig returns the configuration of a server block listening on
+// transport, with the defaults the Caddyfile sets
+func testConfig(transport string) *Config {
+	return &Config{
+		Transport:   transport,
+		GracePeriod: DefaultGracePeriod,
+		UDP: UDPConfig{
+			IdleTimeout:     DefaultUDPIdleTimeout,
+			MaxSessions:     DefaultUDPMaxSessions,
+			QueueSize:       DefaultUDPQueueSize,
+			BatchSize:       DefaultUDPBatchSize,
+			Workers:         DefaultUDPWorkers,
+			MaxDatagramSize: DefaultUDPMaxDatagramSize,
+		},
+		Socket: SocketConfig{NoDelay: true},
+	}
+}
+
+// testServer is a server started by a test, with the
+// addresses it listens on and the errors Serve and
+// ServePacket return once it's stopped
+type testServer struct {
+	tcpAddr string
+	udpAddr string
+	errs    chan error
+}
+
+// serve starts s listening on an ephemeral port of the loopback interface,
+// on the transports of c, the configuration of s
+func serve(t *testing.T, s interface {
+	Listen() (net.Listener, error)
+	ListenPacket() (net.PacketConn, error)
+	Serve(net.Listener) error
+	ServePacket(net.PacketConn) error
+}) *testServer {
+	t.Helper()
+
+	ln, err := s.Listen()
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	pc, err := s.ListenPacket()
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+
+	ts := &testServer{errs: make(chan error, 2)}
+	if ln != nil {
+		ts.tcpAddr = ln.Addr().String()
+	}
+	if pc != nil {
+		ts.udpAddr = pc.LocalAddr().String()
+	}
+	go func() { ts.errs <- s.Serve(ln) }()
+	go func() { ts.errs <- s.ServePacket(pc) }()
+	return ts
+}
+
+// wait waits for Serve and ServePacket to return
+func (ts *testServer) wait(t *testing.T) {
+	t.Helper()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-ts.errs:
+			if err != nil && !isClosed(err) {
+				t.Errorf("serving: %v", err)
+			}
+		case <-time.After(testTimeout):
+			t.Fatal("server didn't return after Stop")
+		}
+	}
+}
+
+// startEchoServer starts an echo server with the configuration c
+func startEchoServer(t *testing.T, c *Config) (*EchoServer, *testServer) {
+	t.Helper()
+
+	s, err := NewEchoServer("127.0.0.1:0", c)
+	if err != nil {
+		t.Fatalf("NewEchoServer: %v", err)
+	}
+	return s, serve(t, s)
+}
+
+// roundTrip sends msg over conn and checks that it comes back
+func roundTrip(conn net.Conn, msg []byte) error {
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	buf := make([]byte, len(msg)+1)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		return fmt.Errorf("got %q, want %q", buf[:n], msg)
+	}
+	return nil
+}
+
+// concurrently runs fn for n clients at the same time and reports their errors
+func concurrently(t *testing.T, n int, fn func(client int) error) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := fn(i); err != nil {
+				errs <- fmt.Errorf("client %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestEchoServerTCP(t *testing.T) {
+	s, ts := startEchoServer(t, testConfig(TransportTCP))
+
+	concurrently(t, 32, func(client int) error {
+		conn, err := net.Dial("tcp", ts.tcpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		for i := 0; i < 10; i++ {
+			if err := roundTrip(conn, []byte(fmt.Sprintf("client %d message %d", client, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	ts.wait(t)
+}
+
+func TestEchoServerUDP(t *testing.T) {
+	for _, workers := range []int{1, 4, 16} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			c := testConfig(TransportUDP)
+			c.UDP.Workers = workers
+			s, ts := startEchoServer(t, c)
+
+			concurrently(t, 32, func(client int) error {
+				conn, err := net.Dial("udp", ts.udpAddr)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+
+				// datagrams may be lost even on the loopback interface
+				// if the socket buffers fill up, so one is sent at a time
+				for i := 0; i < 20; i++ {
+					if err := roundTrip(conn, []byte(fmt.Sprintf("client %d datagram %d", client, i))); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+
+			if err := s.Stop(); err != nil {
+				t.Errorf("Stop: %v", err)
+			}
+			ts.wait(t)
+
+			if echoed := metric(s.metrics, "udp_datagrams_echoed"); echoed != "640" {
+				t.Errorf("udp_datagrams_echoed = %s, want 640", echoed)
+			}
+		})
+	}
+}
+
+func TestEchoServerUDPMaxDatagramSize(t *testing.T) {
+	c := testConfig(TransportUDP)
+	c.UDP.MaxDatagramSize = 16
+	s, ts := startEchoServer(t, c)
+	defer func() {
+		s.Stop()
+		ts.wait(t)
+	}()
+
+	conn, err := net.Dial("udp", ts.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := conn.Write(bytes.Repeat([]byte("x"), 100)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 {
+		t.Errorf("echoed %d bytes, want 16", n)
+	}
+}
+
+// TestEchoServerStopWhileStarting stops servers while they start
+// serving, which must close their listeners either way
+func TestEchoServerStopWhileStarting(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s, err := NewEchoServer("127.0.0.1:0", testConfig(TransportBoth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := s.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := s.ListenPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := &testServer{errs: make(chan error, 2)}
+		go func() { ts.errs <- s.Serve(ln) }()
+		go func() { ts.errs <- s.ServePacket(pc) }()
+		if err := s.Stop(); err != nil && !isClosed(err) {
+			t.Errorf("Stop: %v", err)
+		}
+		ts.wait(t)
+
+		if _, err := ln.Accept(); err == nil || !isClosed(err) {
+			t.Errorf("TCP listener wasn't closed: %v", err)
+		}
+		if _, _, err := pc.ReadFrom(make([]byte, 1)); err == nil || !isClosed(err) {
+			t.Errorf("UDP listener wasn't closed: %v", err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package netserver
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"sync"
+)
+
+// udpFanout copies the datagrams a proxy server receives to a number of
+// additional destinations. Every destination has its own queue and
+// goroutine, so that a slow or unreachable destination never holds up
+// the others, and the replies of the destinations are ignored.
+type udpFanout struct {
+	targets []*fanoutTarget
+	metrics *expvar.Map
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+}
+
+// fanoutTarget is a single destination of a udpFanout
+type fanoutTarget struct {
+	addr    string
+	queue   chan []byte
+	dialer  *upstreamDialer
+	metrics *expvar.Map
+	erred   bool // whether an error has been logged, only used by run
+}
+
+// newUDPFanout returns a fan-out to addrs which queues at most
+// queueSize datagrams per destination
+func newUDPFanout(addrs []string, queueSize int, dialer *upstreamDialer, metrics *expvar.Map) *udpFanout {
+	f := &udpFanout{
+		metrics: metrics,
+		stop:    make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		f.targets = append(f.targets, &fanoutTarget{
+			addr:    addr,
+			queue:   make(chan []byte, queueSize),
+			dialer:  dialer,
+			metrics: metrics,
+		})
+	}
+	return f
+}
+
+// Start starts writing the queued datagrams to the destinations
+func (f *udpFanout) Start() {
+	f.startOnce.Do(func() {
+		for _, t := range f.targets {
+			go t.run(f.stop)
+		}
+	})
+}
+
+// Stop stops writing to the destinations
+func (f *udpFanout) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+}
+
+// Send queues a datagram for every destination. The datagram is shared by
+// the destinations and must not be modified afterwards. Destinations with
+// a full queue drop the datagram.
+func (f *udpFanout) Send(b []byte) {
+	for _, t := range f.targets {
+		select {
+		case t.queue <- b:
+		default:
+			f.metrics.Add("udp_fanout_datagrams_dropped", 1)
+		}
+	}
+}
+
+// run writes the queued datagrams to the destination until stop is closed.
+// Dialing is retried for the next datagram when it fails. Write errors, such
+// as the refused datagrams of a destination that isn't listening, don't close
+// the connection because UDP has no connection state to recover.
+func (t *fanoutTarget) run(stop <-chan struct{}) {
+	var conn *net.UDPConn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for {
+		var b []byte
+		select {
+		case b = <-t.queue:
+		case <-stop:
+			return
+		}
+
+		if conn == nil {
+			c, err := t.dialer.DialUDP(context.Background(), []string{t.addr})
+			if err != nil {
+				t.failed(err)
+				continue
+			}
+			conn = c
+		}
+
+		if _, err := conn.Write(b); err != nil {
+			t.failed(err)
+		}
+	}
+}
+
+// failed counts a datagram that couldn't be written to the destination.
+// Only the first error is logged, as UDP errors don't say whether the
+// destination has recovered since.
+func (t *fanoutTarget) failed(err error) {
+	t.metrics.Add("udp_fanout_write_errors", 1)
+	if !t.erred {
+		log.Printf("[WARNING] Fan-out to %s failed, further errors are only counted: %v", t.addr, err)
+		t.erred = true
+	}
+}
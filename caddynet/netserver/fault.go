@@ -0,0 +1,322 @@
+package netserver
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Types of faults that can be injected into the traffic of a proxy server block
+const (
+	// FaultLatency delays the data by Delay, give or take Jitter
+	FaultLatency = "latency"
+
+	// FaultBandwidth limits the data to Rate bytes per second
+	FaultBandwidth = "bandwidth"
+
+	// FaultReset resets the connection after Delay
+	FaultReset = "reset"
+
+	// FaultDrop drops UDP datagrams
+	FaultDrop = "drop"
+
+	// FaultPartial cuts writes into pieces of at most Bytes bytes, Delay apart
+	FaultPartial = "partial"
+
+	// FaultStall stops forwarding data after Bytes bytes
+	FaultStall = "stall"
+
+	// FaultTimeout stops forwarding data and closes the
+	// connection after Delay, or never if Delay is 0
+	FaultTimeout = "timeout"
+)
+
+// errFaultClosed is returned by the writes of a faultConn
+// that are cut short because the connection was closed
+var errFaultClosed = errors.New("connection closed while injecting a fault")
+
+// Fault is a fault injected into the traffic of a proxy server block
+type Fault struct {
+	// Name of the fault, unique within its server block.
+	// It defaults to the type, followed by a number if taken.
+	Name string
+	Type string
+
+	// Percentage of the TCP connections the fault applies to,
+	// or of the UDP datagrams that are dropped
+	Probability float64
+
+	Delay  time.Duration
+	Jitter time.Duration
+	Rate   int64
+	Bytes  int64
+}
+
+// faultSet holds the faults of a proxy server block,
+// which apply to the connections started after a change
+type faultSet struct {
+	mu     sync.RWMutex
+	faults []Fault
+}
+
+// newFaultSet returns a faultSet with faults, which are
+// named after their type if they don't have a name
+func newFaultSet(faults []Fault) *faultSet {
+	s := &faultSet{}
+	for _, f := range faults {
+		s.Add(f)
+	}
+	return s
+}
+
+// Add adds f to the set and returns it with its name
+func (s *faultSet) Add(f Fault) (Fault, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f.Name == "" {
+		f.Name = f.Type
+		for i := 2; s.find(f.Name) >= 0; i++ {
+			f.Name = fmt.Sprintf("%s_%d", f.Type, i)
+		}
+	} else if s.find(f.Name) >= 0 {
+		return f, fmt.Errorf("duplicate fault %s", f.Name)
+	}
+
+	s.faults = append(s.faults, f)
+	return f, nil
+}
+
+// Remove removes the fault called name, and returns false if there is none
+func (s *faultSet) Remove(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(name)
+	if i < 0 {
+		return false
+	}
+	s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+	return true
+}
+
+// List returns the faults in the set
+func (s *faultSet) List() []Fault {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	faults := make([]Fault, len(s.faults))
+	copy(faults, s.faults)
+	return faults
+}
+
+// find returns the index of the fault called name, or -1.
+// The caller must hold s.mu.
+func (s *faultSet) find(name string) int {
+	for i, f := range s.faults {
+		if f.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Pick returns the faults a new TCP connection gets,
+// each chosen by its probability, or nil if there are none
+func (s *faultSet) Pick() *connFaults {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var f *connFaults
+	for _, fault := range s.faults {
+		if fault.Type == FaultDrop || !chance(fault.Probability) {
+			continue
+		}
+		if f == nil {
+			f = &connFaults{stallAfter: -1, resetAfter: -1, closeAfter: -1}
+		}
+		f.add(fault)
+	}
+	return f
+}
+
+// Drop returns true if a UDP datagram should be dropped
+func (s *faultSet) Drop() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, fault := range s.faults {
+		if fault.Type == FaultDrop && chance(fault.Probability) {
+			return true
+		}
+	}
+	return false
+}
+
+// chance returns true with a probability of percent
+func chance(percent float64) bool {
+	return percent >= 100 || rand.Float64()*100 < percent
+}
+
+// connFaults are the faults of a single TCP connection. Latencies add
+// up, and of the other faults the strictest applies if there are more.
+type connFaults struct {
+	types      []string
+	latency    time.Duration
+	jitter     time.Duration
+	rate       int64
+	piece      int64
+	pieceDelay time.Duration
+	stallAfter int64         // -1 if the connection doesn't stall
+	resetAfter time.Duration // -1 if the connection isn't reset
+	closeAfter time.Duration // -1 if the connection isn't closed
+}
+
+func (f *connFaults) add(fault Fault) {
+	f.types = append(f.types, fault.Type)
+
+	switch fault.Type {
+	case FaultLatency:
+		f.latency += fault.Delay
+		f.jitter += fault.Jitter
+	case FaultBandwidth:
+		if f.rate == 0 || fault.Rate < f.rate {
+			f.rate = fault.Rate
+		}
+	case FaultPartial:
+		if f.piece == 0 || fault.Bytes < f.piece {
+			f.piece, f.pieceDelay = fault.Bytes, fault.Delay
+		}
+	case FaultStall:
+		if f.stallAfter < 0 || fault.Bytes < f.stallAfter {
+			f.stallAfter = fault.Bytes
+		}
+	case FaultReset:
+		if f.resetAfter < 0 || fault.Delay < f.resetAfter {
+			f.resetAfter = fault.Delay
+		}
+	case FaultTimeout:
+		f.stallAfter = 0
+		if fault.Delay > 0 && (f.closeAfter < 0 || fault.Delay < f.closeAfter) {
+			f.closeAfter = fault.Delay
+		}
+	}
+}
+
+// Inject makes lconn and rconn misbehave, until done is closed, and returns
+// the connections to write to instead. Each gets its own faults, so the
+// faults apply to the data in both directions.
+func (f *connFaults) Inject(lconn, rconn net.Conn, done <-chan struct{}) (net.Conn, net.Conn) {
+	if f.resetAfter >= 0 {
+		after(f.resetAfter, done, func() {
+			reset(lconn)
+			reset(rconn)
+		})
+	}
+	if f.closeAfter >= 0 {
+		after(f.closeAfter, done, func() {
+			lconn.Close()
+			rconn.Close()
+		})
+	}
+
+	return &faultConn{Conn: lconn, faults: f, done: done}, &faultConn{Conn: rconn, faults: f, done: done}
+}
+
+// after calls fn after d, unless done is closed first
+func after(d time.Duration, done <-chan struct{}, fn func()) {
+	timer := time.AfterFunc(d, fn)
+	go func() {
+		<-done
+		timer.Stop()
+	}()
+}
+
+// reset closes c, making it send a TCP RST rather than a FIN if possible
+func reset(c net.Conn) {
+	switch wc := c.(type) {
+	case *trackedConn:
+		c = wc.Conn
+	case *pendingConn:
+		c = wc.Conn
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	c.Close()
+}
+
+// faultConn is a connection whose writes are subject to faults
+type faultConn struct {
+	net.Conn
+	faults  *connFaults
+	done    <-chan struct{}
+	written int64 // only used by Write, which isn't called concurrently
+}
+
+// Write writes b to the connection, delayed by the latency, bandwidth and
+// partial write faults. A stalled connection blocks until done is closed.
+func (c *faultConn) Write(b []byte) (int, error) {
+	f := c.faults
+	written := 0
+	for len(b) > 0 {
+		n := int64(len(b))
+		if f.piece > 0 && n > f.piece {
+			n = f.piece
+		}
+		if f.stallAfter >= 0 {
+			if c.written >= f.stallAfter {
+				<-c.done
+				return written, errFaultClosed
+			}
+			if n > f.stallAfter-c.written {
+				n = f.stallAfter - c.written
+			}
+		}
+
+		var wait time.Duration
+		if written == 0 {
+			wait = f.latency
+			if f.jitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(2*f.jitter))) - f.jitter
+			}
+		} else {
+			wait = f.pieceDelay
+		}
+		if f.rate > 0 {
+			wait += time.Duration(n) * time.Second / time.Duration(f.rate)
+		}
+		if !c.sleep(wait) {
+			return written, errFaultClosed
+		}
+
+		m, err := c.Conn.Write(b[:n])
+		written += m
+		c.written += int64(m)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// sleep waits for d, and returns false if done is closed in the meantime
+func (c *faultConn) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-c.done:
+		return false
+	}
+}
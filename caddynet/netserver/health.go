@@ -0,0 +1,130 @@
+package netserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults for upstream health checks
+const (
+	DefaultHealthCheckInterval = 10 * time.Second
+	DefaultHealthCheckTimeout  = 2 * time.Second
+)
+
+// HealthCheckConfig contains the settings of the active health
+// checks of the upstreams of a proxy server block
+type HealthCheckConfig struct {
+	// Time between health checks, 0 disables health checks
+	Interval time.Duration
+
+	// Time a single health check may take
+	Timeout time.Duration
+
+	// Transport used for probes: tcp or udp
+	Transport string
+
+	// Payload sent to the upstream, required for udp probes
+	Send []byte
+
+	// Bytes the response of the upstream must contain, if set
+	Expect []byte
+}
+
+// healthChecker periodically probes the upstreams of a pool
+type healthChecker struct {
+	config HealthCheckConfig
+	dialer *upstreamDialer
+}
+
+// run probes all upstreams of pool every interval until stop is closed
+func (h *healthChecker) run(pool *upstreamPool, stop <-chan struct{}) {
+	ticker := time.NewTicker(h.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		var wg sync.WaitGroup
+		for _, u := range pool.all() {
+			wg.Add(1)
+			go func(u *upstream) {
+				defer wg.Done()
+				h.check(u)
+			}(u)
+		}
+		wg.Wait()
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// check probes u and updates its health, logging any change
+func (h *healthChecker) check(u *upstream) {
+	err := h.probe(u.addr)
+	if err != nil {
+		if atomic.SwapInt32(&u.unhealthy, 1) == 0 {
+			log.Printf("[WARNING] Upstream %s is unhealthy: %v", u.addr, err)
+		}
+		return
+	}
+	if atomic.SwapInt32(&u.unhealthy, 0) == 1 {
+		log.Printf("[INFO] Upstream %s is healthy again", u.addr)
+	}
+}
+
+// probe connects to addr, sends the configured payload and
+// checks the response for the expected bytes
+func (h *healthChecker) probe(addr string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+
+	var conn net.Conn
+	var err error
+	if h.config.Transport == TransportUDP {
+		conn, err = h.dialer.DialUDP(ctx, []string{addr})
+	} else {
+		conn, err = h.dialer.DialTCP(ctx, []string{addr})
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if len(h.config.Send) > 0 {
+		if _, err := conn.Write(h.config.Send); err != nil {
+			return err
+		}
+	}
+
+	if len(h.config.Expect) == 0 && h.config.Transport != TransportUDP {
+		return nil
+	}
+
+	// UDP responses arrive as a single datagram,
+	// TCP responses are read until the expected bytes show up
+	var resp []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return fmt.Errorf("reading response: %v", err)
+		}
+		resp = append(resp, buf[:n]...)
+		if bytes.Contains(resp, h.config.Expect) {
+			return nil
+		}
+		if h.config.Transport == TransportUDP || len(resp) > 64*1024 {
+			return fmt.Errorf("unexpected response")
+		}
+	}
+}
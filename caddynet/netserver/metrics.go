@@ -0,0 +1,15 @@
+package netserver
+
+import "expvar"
+
+// metrics holds the counters of all servers, published through
+// expvar as "caddynet" with an entry per server
+var metrics = expvar.NewMap("caddynet")
+
+// newServerMetrics returns the counters of the server called name,
+// replacing those of a previous server with the same name
+func newServerMetrics(name string) *expvar.Map {
+	m := new(expvar.Map).Init()
+	metrics.Set(name, m)
+	return m
+}
@@ -0,0 +1,187 @@
+package netserver
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// mirrorQueueSize is the number of reads from the client queued for a shadow
+// connection. A shadow that falls further behind is abandoned.
+const mirrorQueueSize = 64
+
+// mirrorFlushTimeout is how long the queued data is written to a shadow
+// upstream for after the client connection has been closed
+const mirrorFlushTimeout = 5 * time.Second
+
+// MirrorConfig contains the settings for shadowing the
+// TCP traffic of a proxy server block to another upstream
+type MirrorConfig struct {
+	// Address the traffic is copied to, mirroring is disabled if empty
+	Addr string
+
+	// Percentage of the connections that are mirrored
+	Percent float64
+}
+
+// tcpMirror copies the data clients send to the upstream of a proxy
+// server to a shadow upstream, whose responses are discarded
+type tcpMirror struct {
+	config  MirrorConfig
+	dialer  *upstreamDialer
+	metrics *expvar.Map
+}
+
+// newTCPMirror returns a tcpMirror for c
+func newTCPMirror(c MirrorConfig, dialer *upstreamDialer, metrics *expvar.Map) *tcpMirror {
+	return &tcpMirror{config: c, dialer: dialer, metrics: metrics}
+}
+
+// Shadow returns a shadow connection for a new client connection, or nil
+// if the connection isn't sampled. The shadow upstream is dialed in the
+// background and the data sent in the meantime is queued.
+func (m *tcpMirror) Shadow() *shadowConn {
+	if m.config.Percent < 100 && rand.Float64()*100 >= m.config.Percent {
+		return nil
+	}
+	m.metrics.Add("mirror_connections_total", 1)
+
+	s := &shadowConn{
+		mirror: m,
+		queue:  make(chan []byte, mirrorQueueSize),
+		finish: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// shadowConn is the connection to the shadow upstream of a single client connection.
+// Failures of the shadow are logged and counted, and never affect the client.
+type shadowConn struct {
+	mirror *tcpMirror
+	queue  chan []byte
+	finish chan struct{}
+	done   chan struct{}
+
+	mu         sync.Mutex
+	conn       net.Conn // nil until dialed
+	finishOnce sync.Once
+	closeOnce  sync.Once
+}
+
+// Send queues a copy of b for the shadow upstream. It never blocks: the
+// shadow is abandoned if its queue is full, as dropping part of the stream
+// would leave the shadow upstream with data that makes no sense.
+func (s *shadowConn) Send(b []byte) {
+	c := make([]byte, len(b))
+	copy(c, b)
+
+	select {
+	case <-s.done:
+	case s.queue <- c:
+	default:
+		s.mirror.metrics.Add("mirror_connections_abandoned", 1)
+		log.Printf("[WARNING] Mirroring to %s can't keep up with the client, stopped mirroring the connection", s.mirror.config.Addr)
+		s.Close()
+	}
+}
+
+// run dials the shadow upstream, discards its responses and writes
+// the queued data to it until s is finished or closed
+func (s *shadowConn) run() {
+	defer s.Close()
+
+	conn, err := s.mirror.dialer.DialTCP(context.Background(), []string{s.mirror.config.Addr})
+	if err != nil {
+		s.failed(err)
+		return
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		// closed while dialing
+		s.mu.Unlock()
+		conn.Close()
+		return
+	default:
+		s.conn = conn
+	}
+	s.mu.Unlock()
+
+	go io.Copy(ioutil.Discard, conn)
+
+	for {
+		select {
+		case b := <-s.queue:
+			if _, err := conn.Write(b); err != nil {
+				s.failed(err)
+				return
+			}
+		case <-s.finish:
+			s.flush(conn)
+			return
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// flush writes the data still queued to the shadow upstream
+func (s *shadowConn) flush(conn net.Conn) {
+	conn.SetWriteDeadline(time.Now().Add(mirrorFlushTimeout))
+	for {
+		select {
+		case b := <-s.queue:
+			if _, err := conn.Write(b); err != nil {
+				s.failed(err)
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// failed counts and logs an error of the shadow and closes it
+func (s *shadowConn) failed(err error) {
+	select {
+	case <-s.done:
+		// errors caused by closing s aren't failures
+		return
+	default:
+	}
+
+	s.mirror.metrics.Add("mirror_connections_failed", 1)
+	log.Printf("[WARNING] Mirroring to %s failed: %v", s.mirror.config.Addr, err)
+	s.Close()
+}
+
+// Finish closes the shadow connection once the data queued
+// so far has been written. It's safe to call Finish more than once.
+func (s *shadowConn) Finish() {
+	s.finishOnce.Do(func() {
+		close(s.finish)
+	})
+}
+
+// Close closes the shadow connection at once. It's safe to call Close
+// more than once and from any goroutine.
+func (s *shadowConn) Close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		close(s.done)
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	})
+}
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddyfile"
@@ -15,7 +18,7 @@ const serverType = "net"
 // directives for the net server type
 // The ordering of this list is important, host need to be called before
 // tls to get the relevant hostname needed
-var directives = []string{"host", "tls"}
+var directives = []string{"host", "tls", "transport", "socket", "dial", "resolver", "grace_period", "udp", "upstream", "group", "fanout", "mirror", "prewarm", "fault", "health_check", "token"}
 
 func init() {
 
@@ -56,18 +59,63 @@ func (n *netContext) saveConfig(key string, cfg *Config) {
 
 type configTokens map[string][]string
 
+// instanceState is the state of a Caddy instance shared by its servers
+type instanceState struct {
+	// restarting is set while the instance is replaced by a reload,
+	// accessed atomically
+	restarting int32
+
+	stopOnce    sync.Once
+	stopStarted time.Time
+}
+
+// stopping returns when the first server of the instance was stopped,
+// which is now if none were
+func (st *instanceState) stopping() time.Time {
+	st.stopOnce.Do(func() {
+		st.stopStarted = time.Now()
+	})
+	return st.stopStarted
+}
+
+// newInstanceState returns the state of inst, which
+// is kept up to date through the callbacks of inst
+func newInstanceState(inst *caddy.Instance) *instanceState {
+	st := &instanceState{}
+	if inst == nil {
+		return st
+	}
+
+	inst.OnRestart = append(inst.OnRestart, func() error {
+		atomic.StoreInt32(&st.restarting, 1)
+		return nil
+	})
+	inst.OnRestartFailed = append(inst.OnRestartFailed, func() error {
+		atomic.StoreInt32(&st.restarting, 0)
+		return nil
+	})
+	return st
+}
+
 // InspectServerBlocks make sure that everything checks out before
 // executing directives and otherwise prepares the directives to
 // be parsed and executed.
 func (n *netContext) InspectServerBlocks(sourceFile string, serverBlocks []caddyfile.ServerBlock) ([]caddyfile.ServerBlock, error) {
 	cfg := make(map[string]configTokens)
 
+	// the last key of each server block as written, because keys are
+	// lowercased but a destination may be case sensitive i.e a file path
+	lastKeys := make(map[string]string)
+
 	// Example:
 	// proxy :12017 :22017 {
 	//	host localhost
 	//	tls off
 	// }
 	// ServerBlock Keys will be proxy :12017 :22017 and Tokens will be host and tls
+	//
+	// A proxy server block may list several listen addresses before the destination
+	// and ports may be given as ranges i.e proxy :30000-30100 10.0.0.5:30000-30100
 
 	// For each key in each server block, make a new config
 	for _, sb := range serverBlocks {
@@ -94,6 +142,7 @@ func (n *netContext) InspectServerBlocks(sourceFile string, serverBlocks []caddy
 		}
 
 		cfg[key] = tokens
+		lastKeys[key] = sb.Keys[len(sb.Keys)-1]
 	}
 
 	// build the actual Config from gathered data
@@ -112,6 +161,39 @@ func (n *netContext) InspectServerBlocks(sourceFile string, serverBlocks []caddy
 			return serverBlocks, fmt.Errorf("invalid configuration: proxy server block expects a source and destination address")
 		}
 
+		if listenType == "admin" && len(params) != 1 {
+			return serverBlocks, fmt.Errorf("invalid configuration: admin server block expects a single address")
+		}
+
+		// the last parameter of a proxy server block is the destination,
+		// all the others are addresses to listen on
+		listenAddrs := params
+		destAddr := ""
+		if listenType == "admin" {
+			// keep the case of unix socket paths
+			listenAddrs = []string{lastKeys[k]}
+		}
+		if listenType == "proxy" {
+			listenAddrs = params[:len(params)-1]
+			destAddr = lastKeys[k]
+			if t, _ := splitTransport(destAddr); t != "" {
+				return serverBlocks, fmt.Errorf("invalid configuration: transport prefix only allowed on listen address: %s", destAddr)
+			}
+		}
+
+		// listen addresses may be prefixed with the transport to use i.e udp/:53
+		transport := ""
+		for i, l := range listenAddrs {
+			t, addr := splitTransport(l)
+			if t != "" && transport != "" && t != transport {
+				return serverBlocks, fmt.Errorf("invalid configuration: mixed transport prefixes in %s", k)
+			}
+			if t != "" {
+				transport = t
+			}
+			listenAddrs[i] = addr
+		}
+
 		// Make our caddytls.Config, which has a pointer to the
 		// instance's certificate cache
 		caddytlsConfig, err := caddytls.NewConfig(n.instance)
@@ -121,10 +203,23 @@ func (n *netContext) InspectServerBlocks(sourceFile string, serverBlocks []caddy
 
 		// Save the config to our master list, and key it for lookups
 		c := &Config{
-			TLS:        caddytlsConfig,
-			Type:       listenType,
-			ListenPort: params[0], // first element should always be the port
-			Parameters: params,
+			TLS:         caddytlsConfig,
+			Type:        listenType,
+			ListenPort:  params[0], // first element should always be the port
+			ListenAddrs: listenAddrs,
+			DestAddr:    destAddr,
+			Transport:   transport,
+			Parameters:  params,
+			GracePeriod: DefaultGracePeriod,
+			UDP: UDPConfig{
+				IdleTimeout:     DefaultUDPIdleTimeout,
+				MaxSessions:     DefaultUDPMaxSessions,
+				QueueSize:       DefaultUDPQueueSize,
+				BatchSize:       DefaultUDPBatchSize,
+				Workers:         DefaultUDPWorkers,
+				MaxDatagramSize: DefaultUDPMaxDatagramSize,
+			},
+			Socket: SocketConfig{NoDelay: true},
 		}
 
 		n.saveConfig(k, c)
@@ -137,38 +232,101 @@ func (n *netContext) InspectServerBlocks(sourceFile string, serverBlocks []caddy
 func (n *netContext) MakeServers() ([]caddy.Server, error) {
 	//  create servers based on config type
 	var servers []caddy.Server
+	var blocks []*serverBlock
+	var admins []*AdminServer
+	bound := make(map[string]bool)
+	instance := newInstanceState(n.instance)
 	for _, cfg := range n.configs {
-		switch cfg.Type {
-		case "echo":
-			s, err := NewEchoServer(cfg.Parameters[0], cfg)
-			if err != nil {
-				return nil, err
+		if cfg.Type == "admin" {
+			// the admin API is only served over TCP
+			if cfg.Transport != "" && cfg.Transport != TransportTCP {
+				return nil, fmt.Errorf("admin server block only supports the tcp transport")
 			}
-			servers = append(servers, s)
-		case "proxy":
-			s, err := NewProxyServer(cfg.Parameters[0], cfg.Parameters[1], cfg)
-			if err != nil {
-				return nil, err
+			cfg.Transport = TransportTCP
+		}
+		if cfg.Transport == "" {
+			cfg.Transport = TransportBoth
+		}
+		cfg.instance = instance
+
+		mappings, err := mapAddresses(cfg)
+		if err != nil {
+			return nil, err
+		}
+
+		block := &serverBlock{config: cfg}
+		if cfg.Type != "admin" {
+			blocks = append(blocks, block)
+		}
+
+		// a server is created for every listen address of the server block
+		for _, m := range mappings {
+			// the same port may be used by different server blocks as long as
+			// they don't listen on the same transport
+			for _, t := range []string{TransportTCP, TransportUDP} {
+				if (t == TransportTCP && !cfg.ServesTCP()) || (t == TransportUDP && !cfg.ServesUDP()) {
+					continue
+				}
+				addr := t + "/" + m.Listen
+				if bound[addr] {
+					return nil, fmt.Errorf("address already in use by another server block: %s", addr)
+				}
+				bound[addr] = true
 			}
-			servers = append(servers, s)
 
+			switch cfg.Type {
+			case "echo":
+				s, err := NewEchoServer(m.Listen, cfg)
+				if err != nil {
+					return nil, err
+				}
+				servers = append(servers, s)
+				block.echoes = append(block.echoes, s)
+			case "proxy":
+				s, err := NewProxyServer(m.Listen, m.Dest, cfg)
+				if err != nil {
+					return nil, err
+				}
+				servers = append(servers, s)
+				block.proxies = append(block.proxies, s)
+			case "admin":
+				s := NewAdminServer(m.Listen, cfg)
+				servers = append(servers, s)
+				admins = append(admins, s)
+			}
 		}
 	}
 
+	// admin servers manage the server blocks of the whole instance
+	for _, s := range admins {
+		s.blocks = blocks
+	}
+
 	return servers, nil
 }
 
+// splitTransport splits a tcp/ or udp/ prefix from addr.
+// The returned transport is empty if addr has no prefix.
+func splitTransport(addr string) (string, string) {
+	for _, t := range []string{TransportTCP, TransportUDP} {
+		if strings.HasPrefix(addr, t+"/") {
+			return t, strings.TrimPrefix(addr, t+"/")
+		}
+	}
+	return "", addr
+}
+
 // GetConfig gets the Config that corresponds to c.
 // If none exist (should only happen in tests), then a
 // new, empty one will be created.
 func GetConfig(c *caddy.Controller) *Config {
 	ctx := c.Context().(*netContext)
-	key := strings.Join(c.ServerBlockKeys, "~")
+	key := strings.ToLower(strings.Join(c.ServerBlockKeys, "~"))
 
-	//only check for config if the value is proxy or echo
+	//only check for config if the value is proxy, echo or admin
 	//we need to do this because we specify the ports in the server block
 	//and those values need to be ignored as they are also sent from caddy main process.
-	if strings.Contains(key, "echo") || strings.Contains(key, "proxy") {
+	if strings.Contains(key, "echo") || strings.Contains(key, "proxy") || strings.Contains(key, "admin") {
 		if cfg, ok := ctx.keysToConfigs[key]; ok {
 			return cfg
 		}
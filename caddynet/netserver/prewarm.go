@@ -0,0 +1,361 @@
+package netserver
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultPrewarmMaxIdle is how long a pre-warmed upstream
+// connection is kept idle before it's replaced
+const DefaultPrewarmMaxIdle = 30 * time.Second
+
+// prewarmRefillInterval is how often the pools of pre-warmed upstream
+// connections are topped up to their minimum size and checked for age
+const prewarmRefillInterval = time.Second
+
+// prewarmMaxPending is the most data an upstream may send on an idle
+// connection before it's paired with a client. Connections to upstreams
+// that send more aren't reused.
+const prewarmMaxPending = 64 * 1024
+
+// PrewarmConfig contains the settings for keeping idle
+// connections to the upstreams of a proxy server block ready
+type PrewarmConfig struct {
+	// Idle connections kept ready per upstream, 0 disables pre-warming
+	Min int
+
+	// Most idle connections per upstream, when clients take them faster
+	// than they are refilled more are dialed, up to Max
+	Max int
+
+	// Time an idle connection is kept before it's replaced
+	MaxIdle time.Duration
+}
+
+// prewarmPool keeps idle connections to each upstream of a proxy
+// server, so that new clients don't wait for the upstream to be dialed
+type prewarmPool struct {
+	config  PrewarmConfig
+	dialer  *upstreamDialer
+	addrs   func() []string
+	metrics *expvar.Map
+
+	mu     sync.Mutex
+	queues map[string]*prewarmQueue
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+}
+
+// prewarmQueue holds the idle connections to a single upstream, oldest first
+type prewarmQueue struct {
+	idle    []*warmConn
+	dialing int
+}
+
+// newPrewarmPool returns a pool that keeps connections ready to the
+// upstreams addrs returns, which are dialed with dialer
+func newPrewarmPool(c PrewarmConfig, dialer *upstreamDialer, addrs func() []string, metrics *expvar.Map) *prewarmPool {
+	p := &prewarmPool{
+		config:  c,
+		dialer:  dialer,
+		addrs:   addrs,
+		metrics: metrics,
+		queues:  make(map[string]*prewarmQueue),
+		stop:    make(chan struct{}),
+	}
+	metrics.Set("prewarm_idle", expvar.Func(func() interface{} { return p.Len() }))
+	return p
+}
+
+// Start fills the pool and keeps it filled until Stop is called.
+// It's safe to call Start more than once.
+func (p *prewarmPool) Start() {
+	p.startOnce.Do(func() {
+		go p.run()
+	})
+}
+
+// Stop stops refilling the pool and closes the idle connections
+func (p *prewarmPool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		for addr, q := range p.queues {
+			for _, c := range q.idle {
+				c.Close()
+			}
+			delete(p.queues, addr)
+		}
+	})
+}
+
+// Len returns the number of idle connections
+func (p *prewarmPool) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, q := range p.queues {
+		n += len(q.idle)
+	}
+	return n
+}
+
+// Get returns an idle connection to addr, or nil if there is none.
+// Either way another connection is dialed in the background if the
+// pool for addr isn't full.
+func (p *prewarmPool) Get(addr string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q := p.queues[addr]
+	if q == nil {
+		p.metrics.Add("prewarm_misses", 1)
+		return nil
+	}
+	if len(q.idle)+q.dialing < p.config.Max {
+		p.dial(addr, q)
+	}
+
+	// the newest connections are the least likely to have been closed
+	for len(q.idle) > 0 {
+		c := q.idle[len(q.idle)-1]
+		q.idle = q.idle[:len(q.idle)-1]
+		if conn := c.Take(); conn != nil {
+			p.metrics.Add("prewarm_hits", 1)
+			return conn
+		}
+	}
+	p.metrics.Add("prewarm_misses", 1)
+	return nil
+}
+
+// run tops up the pool every prewarmRefillInterval until it's stopped
+func (p *prewarmPool) run() {
+	ticker := time.NewTicker(prewarmRefillInterval)
+	defer ticker.Stop()
+
+	for {
+		p.refill()
+
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// refill closes the idle connections that are too old or whose upstream
+// is gone, and dials connections until every upstream has Min of them
+func (p *prewarmPool) refill() {
+	current := make(map[string]bool)
+	for _, addr := range p.addrs() {
+		current[addr] = true
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+
+	for addr, q := range p.queues {
+		if !current[addr] {
+			for _, c := range q.idle {
+				c.Close()
+			}
+			delete(p.queues, addr)
+		}
+	}
+
+	for addr := range current {
+		q := p.queues[addr]
+		if q == nil {
+			q = &prewarmQueue{}
+			p.queues[addr] = q
+		}
+
+		idle := q.idle[:0]
+		for _, c := range q.idle {
+			if c.Expired(p.config.MaxIdle) {
+				c.Close()
+				p.metrics.Add("prewarm_expired", 1)
+			} else {
+				idle = append(idle, c)
+			}
+		}
+		q.idle = idle
+
+		for n := len(q.idle) + q.dialing; n < p.config.Min; n++ {
+			p.dial(addr, q)
+		}
+	}
+}
+
+// dial dials a connection to addr in the background and adds it to q.
+// The caller must hold p.mu.
+func (p *prewarmPool) dial(addr string, q *prewarmQueue) {
+	q.dialing++
+	go func() {
+		conn, err := p.dialer.DialTCP(context.Background(), []string{addr})
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		q.dialing--
+		if err != nil {
+			p.metrics.Add("prewarm_dial_errors", 1)
+			return
+		}
+
+		select {
+		case <-p.stop:
+			conn.Close()
+			return
+		default:
+		}
+		if p.queues[addr] != q {
+			// the upstream was removed while dialing
+			conn.Close()
+			return
+		}
+
+		c := newWarmConn(conn)
+		q.idle = append(q.idle, c)
+		go c.watch(func() { p.remove(addr, c) })
+	}()
+}
+
+// remove drops c, which was closed by the upstream, from the pool
+func (p *prewarmPool) remove(addr string, c *warmConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	q := p.queues[addr]
+	if q == nil {
+		return
+	}
+	for i, idle := range q.idle {
+		if idle == c {
+			q.idle = append(q.idle[:i], q.idle[i+1:]...)
+			return
+		}
+	}
+}
+
+// warmConn is an idle upstream connection. It's read from while it's idle,
+// to notice when the upstream closes it and to keep what the upstream sends
+// first, such as the greeting of a server-speaks-first protocol.
+type warmConn struct {
+	conn    net.Conn
+	created time.Time
+	pending []byte
+	done    chan struct{} // closed when watch returns
+
+	mu    sync.Mutex
+	taken bool
+	dead  bool
+}
+
+func newWarmConn(conn net.Conn) *warmConn {
+	return &warmConn{conn: conn, created: time.Now(), done: make(chan struct{})}
+}
+
+// watch reads from the idle connection until it's taken. If the upstream
+// closes it, or sends too much, it's closed and closed is called.
+func (c *warmConn) watch(closed func()) {
+	defer close(c.done)
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.conn.Read(buf)
+
+		c.mu.Lock()
+		c.pending = append(c.pending, buf[:n]...)
+		taken := c.taken
+		if !taken && (err != nil || len(c.pending) > prewarmMaxPending) {
+			c.dead = true
+		}
+		dead := c.dead
+		c.mu.Unlock()
+
+		if taken && err != nil {
+			// Take interrupted the read
+			return
+		}
+		if dead {
+			c.conn.Close()
+			closed()
+			return
+		}
+	}
+}
+
+// Take stops watching the connection and returns it, with what the upstream
+// sent while it was idle still to be read. It returns nil if the connection
+// was closed in the meantime.
+func (c *warmConn) Take() net.Conn {
+	c.mu.Lock()
+	if c.dead {
+		c.mu.Unlock()
+		return nil
+	}
+	c.taken = true
+	c.mu.Unlock()
+
+	c.conn.SetReadDeadline(time.Now())
+	<-c.done
+	c.conn.SetReadDeadline(time.Time{})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.dead {
+		return nil
+	}
+	if len(c.pending) == 0 {
+		return c.conn
+	}
+	return &pendingConn{Conn: c.conn, pending: c.pending}
+}
+
+// Expired returns true if the connection has been idle for longer than maxIdle
+func (c *warmConn) Expired(maxIdle time.Duration) bool {
+	return maxIdle > 0 && time.Since(c.created) > maxIdle
+}
+
+// Close closes the idle connection
+func (c *warmConn) Close() {
+	c.mu.Lock()
+	c.dead = true
+	c.mu.Unlock()
+
+	c.conn.Close()
+}
+
+// pendingConn is a connection whose first reads return pending
+type pendingConn struct {
+	net.Conn
+	pending []byte
+}
+
+func (c *pendingConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
@@ -1,34 +1,184 @@
 package netserver
 
-import "net"
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // proxyUDPConnection resembles a UDP proxy connection and pipe data between local and remote.
+// Datagrams from the client are queued and written to the remote server by a goroutine of
+// the session, so that a slow or unreachable upstream never blocks the other clients.
 type proxyUDPConnection struct {
-	lconn     net.PacketConn
-	laddr     net.Addr     // Address of the client
-	rconn     *net.UDPConn // UDP connection to remote server
-	closeChan chan string
+	lastActive  int64  // UnixNano of the last datagram in either direction, accessed atomically
+	dropped     int64  // Datagrams dropped because the queue was full, accessed atomically
+	received    uint64 // Bytes received from the client, accessed atomically
+	sent        uint64 // Bytes sent to the client, accessed atomically
+	id          uint64 // ID of the session, shared with the TCP connections for the admin API
+	started     time.Time
+	laddr       net.Addr // Address of the client
+	local       net.IP   // Local address the client sends to, replies are sent from it
+	replies     chan<- datagram
+	idleTimeout time.Duration
+	queue       chan []byte
+	closed      func(p *proxyUDPConnection, idle bool)
+	drop        func() bool // reports whether a reply is dropped, may be nil
+
+	mu        sync.Mutex
+	rconn     *net.UDPConn // UDP connection to remote server, nil until dialed
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// Wait reads packets from remote server and forwards it on to the client connection
-func (p *proxyUDPConnection) Wait() {
-	buf := make([]byte, 32*1024) // THIS SHOULD BE CONFIGURABLE
+// newProxyUDPConnection returns a session for the client at laddr which queues
+// at most queueSize datagrams for the remote server and sends the datagrams
+// it receives from the remote server to replies. The replies are sent from
+// local, the address the client sent its first datagram to, if it's known.
+func newProxyUDPConnection(laddr net.Addr, local net.IP, replies chan<- datagram, queueSize int, idleTimeout time.Duration) *proxyUDPConnection {
+	p := &proxyUDPConnection{
+		id:          atomic.AddUint64(&lastConnID, 1),
+		started:     time.Now(),
+		laddr:       laddr,
+		local:       local,
+		replies:     replies,
+		idleTimeout: idleTimeout,
+		queue:       make(chan []byte, queueSize),
+		done:        make(chan struct{}),
+	}
+	p.touch()
+	return p
+}
+
+// Send queues a datagram for the remote server. It returns false,
+// and the datagram is dropped, if the queue of the session is full.
+func (p *proxyUDPConnection) Send(b []byte) bool {
+	select {
+	case p.queue <- b:
+		p.touch()
+		atomic.AddUint64(&p.received, uint64(len(b)))
+		return true
+	default:
+		atomic.AddInt64(&p.dropped, 1)
+		return false
+	}
+}
+
+// Wait connects to the remote server using dial, then forwards the queued datagrams
+// to it and reads packets from the remote server and forwards them on to the client
+// connection. It returns when the session has been idle for longer than the idle
+// timeout, on the first error or when the session is closed, after which closed is
+// called.
+func (p *proxyUDPConnection) Wait(dial func() (*net.UDPConn, error)) {
+	idle := false
+	defer func() {
+		p.Close()
+		p.closed(p, idle)
+	}()
+
+	rconn, err := dial()
+	if err != nil {
+		log.Printf("[ERROR] Cannot connect to remote server for %s: %v", p.laddr, err)
+		return
+	}
+
+	p.mu.Lock()
+	select {
+	case <-p.done:
+		// closed while dialing
+		p.mu.Unlock()
+		rconn.Close()
+		return
+	default:
+		p.rconn = rconn
+	}
+	p.mu.Unlock()
+
+	go p.forward(rconn)
+
 	for {
+		if p.idleTimeout > 0 {
+			rconn.SetReadDeadline(p.lastActiveTime().Add(p.idleTimeout))
+		}
+
 		// Read from server
-		n, err := p.rconn.Read(buf)
+		buf := getUDPBuffer()
+		n, err := rconn.Read(buf)
 		if err != nil {
-			p.closeChan <- p.laddr.String()
+			putUDPBuffer(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// the client may have sent data since the deadline was set
+				if time.Since(p.lastActiveTime()) < p.idleTimeout {
+					continue
+				}
+				idle = true
+			}
 			return
 		}
+		p.touch()
+
+		if p.drop != nil && p.drop() {
+			putUDPBuffer(buf)
+			continue
+		}
+
 		// Relay data from remote back to client
-		_, err = p.lconn.WriteTo(buf[0:n], p.laddr)
-		if err != nil {
-			p.closeChan <- p.laddr.String()
+		select {
+		case p.replies <- datagram{buf: buf, n: n, addr: p.laddr, local: p.local}:
+			atomic.AddUint64(&p.sent, uint64(n))
+		case <-p.done:
+			putUDPBuffer(buf)
 			return
 		}
 	}
 }
 
+// forward writes the queued datagrams to the remote server until the session is closed
+func (p *proxyUDPConnection) forward(rconn *net.UDPConn) {
+	for {
+		select {
+		case b := <-p.queue:
+			if _, err := rconn.Write(b); err != nil {
+				p.Close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// touch marks the session as active
+func (p *proxyUDPConnection) touch() {
+	atomic.StoreInt64(&p.lastActive, time.Now().UnixNano())
+}
+
+func (p *proxyUDPConnection) lastActiveTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastActive))
+}
+
+// Upstream returns the address of the remote server, once it's dialed
+func (p *proxyUDPConnection) Upstream() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.rconn == nil {
+		return ""
+	}
+	return p.rconn.RemoteAddr().String()
+}
+
+// Close closes the session. It's safe to call Close more than once
+// and from any goroutine.
 func (p *proxyUDPConnection) Close() {
-	p.rconn.Close()
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		close(p.done)
+		if p.rconn != nil {
+			p.rconn.Close()
+		}
+	})
 }
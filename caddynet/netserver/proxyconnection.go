@@ -1,41 +1,102 @@
 package netserver
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 // proxyConnection resembles a proxy connection and pipe data between local and remote.
 type proxyConnection struct {
 	sentBytes     uint64
 	receivedBytes uint64
-	laddr, raddr  string
-	lconn, rconn  net.Conn
-	erred         bool
-	closeSignal   chan bool
+	laddr         string
+	raddrs        []string
+	group         string // upstream group raddrs are from, if the traffic is split
+	lconn         *trackedConn
+	rconn         net.Conn
+	dialer        *upstreamDialer
+	prewarm       *prewarmPool // nil if no upstream connections are pre-warmed
+	mirror        *tcpMirror   // nil if the server block doesn't mirror traffic
+	shadow        *shadowConn  // nil if the connection isn't mirrored
+	faults        *connFaults  // nil if no faults are injected into the connection
+
+	// ctx is cancelled once the connection closes, which cancels the dial
+	// and stops the faults. closeOnce makes sure only the first error,
+	// which caused the close, is logged.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
 }
 
 // proxy establishes the connection to the remote server and
-// starts data exchange. It will block until a close signal is received
-// so it's advisable to call as a goroutine
+// starts data exchange. It blocks until either side is closed,
+// and returns once both connections are closed and the goroutines
+// exchanging data have returned, so it's advisable to call as a goroutine.
 func (p *proxyConnection) proxy() {
+	defer p.cancel()
 	defer p.lconn.Close()
-	var err error
 
-	p.rconn, err = net.Dial("tcp", p.raddr)
+	// complete the TLS handshake before dialing the remote server,
+	// so that clients failing it never reach the remote server
+	err := p.lconn.Handshake()
 	if err != nil {
-		p.errorFunc("Cannot connect to remote connection: %s", err)
+		fmt.Printf("[ERROR] TLS handshake with %s failed: %v\n", p.lconn.RemoteAddr(), err)
 		return
 	}
+
+	// pair the client with a ready connection to the chosen upstream, if any
+	if p.prewarm != nil && len(p.raddrs) > 0 {
+		p.rconn = p.prewarm.Get(p.raddrs[0])
+	}
+	if p.rconn == nil {
+		p.rconn, err = p.dialer.DialTCP(p.ctx, p.raddrs)
+		if err != nil {
+			p.errorFunc("Cannot connect to remote connection: %s", err)
+			return
+		}
+	}
 	defer p.rconn.Close()
+	p.lconn.SetUpstream(p.rconn.RemoteAddr().String())
+
+	if p.mirror != nil {
+		p.shadow = p.mirror.Shadow()
+		if p.shadow != nil {
+			defer p.shadow.Finish()
+		}
+	}
+
+	// writes go through the faults, if any, until the connection is closed
+	var lconn, rconn net.Conn = p.lconn, p.rconn
+	if p.faults != nil {
+		lconn, rconn = p.faults.Inject(p.lconn, p.rconn, p.ctx.Done())
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.exchangeData(rconn, p.lconn)
+	}()
+	go func() {
+		defer wg.Done()
+		p.exchangeData(lconn, p.rconn)
+	}()
 
-	go p.exchangeData(p.rconn, p.lconn)
-	go p.exchangeData(p.lconn, p.rconn)
+	// closing both connections once either side is done
+	// unblocks the reads and writes of the other direction
+	<-p.ctx.Done()
+	p.lconn.Close()
+	p.rconn.Close()
+	wg.Wait()
 
-	//wait for close signal
-	<-p.closeSignal
-	fmt.Printf("Done proxying: %s %s\n", p.lconn.LocalAddr(), p.rconn.LocalAddr())
+	if p.group != "" {
+		fmt.Printf("Done proxying: %s %s group=%s\n", p.lconn.LocalAddr(), p.rconn.LocalAddr(), p.group)
+	} else {
+		fmt.Printf("Done proxying: %s %s\n", p.lconn.LocalAddr(), p.rconn.LocalAddr())
+	}
 }
 
 // exchangeData reads from source connection and forwards
@@ -56,24 +117,22 @@ func (p *proxyConnection) exchangeData(dst, src net.Conn) {
 				p.errorFunc("Cannot write to remote connection", err)
 				return
 			}
+
+			// copy what the client sent to the shadow upstream, if any
+			if p.shadow != nil && src == p.lconn {
+				p.shadow.Send(b)
+			}
 		}
 	}
 }
 
-// errorFunc handles errors and send a close signal
+// errorFunc logs the error that ends the connection and closes it.
+// Errors caused by the close, or by another error, aren't logged.
 func (p *proxyConnection) errorFunc(s string, err error) {
-	if p.erred {
-		return
-	}
-	if err != io.EOF {
-		fmt.Printf("[ERROR] %s Err:%s\n", s, err)
-	}
-	p.closeSignal <- true
-	p.erred = true
-}
-
-// close sends close signal
-func (p *proxyConnection) close() {
-	p.closeSignal <- true
-	p.erred = true
+	p.closeOnce.Do(func() {
+		if err != io.EOF {
+			fmt.Printf("[ERROR] %s Err:%s\n", s, err)
+		}
+		p.cancel()
+	})
 }
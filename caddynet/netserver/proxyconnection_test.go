@@ -0,0 +1,101 @@
+package netserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a connection over the loopback interface
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accepting the connection failed")
+	}
+	return dialed, conn
+}
+
+// testProxyConnectionClose proxies between a client and an upstream
+// until closeFn ends the connection, and checks that both connections
+// of the proxy are closed and its goroutines have returned
+func testProxyConnectionClose(t *testing.T, closeFn func(cancel context.CancelFunc, client, upstream net.Conn)) {
+	client, lconn := tcpPair(t)
+	defer client.Close()
+	rconn, upstream := tcpPair(t)
+	defer upstream.Close()
+
+	baseline := runtime.NumGoroutine()
+
+	tc := newConnTracker("test").Add(lconn)
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &proxyConnection{lconn: tc, rconn: rconn, ctx: ctx, cancel: cancel}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.proxy()
+	}()
+
+	// make sure the data is exchanged before the connection is closed
+	upstream.SetDeadline(time.Now().Add(testTimeout))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(upstream, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	closeFn(cancel, client, upstream)
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("proxy didn't return after the connection was closed")
+	}
+
+	if _, err := lconn.Read(make([]byte, 1)); !isClosed(err) {
+		t.Errorf("client connection wasn't closed: %v", err)
+	}
+	if _, err := rconn.Read(make([]byte, 1)); !isClosed(err) {
+		t.Errorf("upstream connection wasn't closed: %v", err)
+	}
+	eventually(t, "the goroutines of the connection to return", func() bool {
+		return runtime.NumGoroutine() <= baseline
+	})
+}
+
+func TestProxyConnectionCancel(t *testing.T) {
+	testProxyConnectionClose(t, func(cancel context.CancelFunc, client, upstream net.Conn) {
+		cancel()
+	})
+}
+
+func TestProxyConnectionClientClose(t *testing.T) {
+	testProxyConnectionClose(t, func(cancel context.CancelFunc, client, upstream net.Conn) {
+		client.Close()
+	})
+}
+
+func TestProxyConnectionUpstreamClose(t *testing.T) {
+	testProxyConnectionClose(t, func(cancel context.CancelFunc, client, upstream net.Conn) {
+		upstream.Close()
+	})
+}
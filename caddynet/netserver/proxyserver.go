@@ -1,66 +1,133 @@
 package netserver
 
 import (
+	"context"
 	"crypto/tls"
+	"expvar"
 	"fmt"
 	"net"
+	"strings"
+	"sync/atomic"
 
 	"github.com/caddyserver/caddy"
 	"github.com/caddyserver/caddy/caddytls"
 )
 
 // ProxyServer is an implementation of the
-// caddy.Server interface type
+// caddy.GracefulServer interface type
 type ProxyServer struct {
-	LocalTCPAddr    string
-	DestTCPAddr     string
-	tcpListener     net.Listener
-	config          *Config
-	udpPacketConn   net.PacketConn
-	udpClients      map[string]*proxyUDPConnection
-	udpClientClosed chan string
+	LocalTCPAddr string
+	DestTCPAddr  string
+	listeners    serverListeners
+	config       *Config
+	tlsConfig    *tls.Config
+	udpClients   *udpSessionTable
+	dialer       *upstreamDialer
+	upstreams    *upstreamSplit
+	fanout       *udpFanout
+	mirror       *tcpMirror
+	faults       *faultSet
+	prewarm      *prewarmPool
+	metrics      *expvar.Map
+	udpReplies   chan datagram
+	conns        *connTracker
 }
 
 // NewProxyServer returns a new proxy server
 func NewProxyServer(l string, d string, c *Config) (*ProxyServer, error) {
-	return &ProxyServer{
+	if c.resolver == nil {
+		c.resolver = newResolver(c.Resolver)
+	}
+	if c.faults == nil {
+		c.faults = newFaultSet(c.Faults)
+	}
+
+	tlsConfig, err := caddytls.MakeTLSConfig([]*caddytls.Config{c.TLS})
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := newUpstreamDialer(c.Dial, c.Socket, c.resolver)
+
+	s := &ProxyServer{
 		LocalTCPAddr: l,
 		DestTCPAddr:  d,
 		config:       c,
-		udpClients:   make(map[string]*proxyUDPConnection),
-	}, nil
-}
+		tlsConfig:    tlsConfig,
+		udpClients:   newUDPSessionTable(serverAddress(l, c), c.UDP.MaxSessions),
+		dialer:       dialer,
+		upstreams:    newUpstreamSplit(append([]string{d}, c.Upstreams...), c),
+		metrics:      newServerMetrics("proxy " + serverAddress(l, c)),
+		udpReplies:   make(chan datagram, c.UDP.BatchSize),
+		conns:        newConnTracker(serverAddress(l, c)),
+		faults:       c.faults,
+	}
 
-// Listen starts listening by creating a new listener
-// and returning it. It does not start accepting
-// connections.
-func (s *ProxyServer) Listen() (net.Listener, error) {
-	var listener net.Listener
+	if c.Mirror.Addr != "" {
+		s.mirror = newTCPMirror(c.Mirror, dialer, s.metrics)
+	}
 
-	tlsConfig, err := caddytls.MakeTLSConfig([]*caddytls.Config{s.config.TLS})
-	if err != nil {
-		return nil, err
+	if c.Prewarm.Min > 0 || c.Prewarm.Max > 0 {
+		s.prewarm = newPrewarmPool(c.Prewarm, dialer, s.upstreams.Active, s.metrics)
 	}
 
-	inner, err := net.Listen("tcp", fmt.Sprintf("%s", s.LocalTCPAddr))
-	if err != nil {
-		return nil, err
+	if len(c.Fanout) > 0 {
+		s.fanout = newUDPFanout(c.Fanout, c.UDP.QueueSize, dialer, s.metrics)
 	}
 
-	if tlsConfig != nil {
-		listener = tls.NewListener(inner, tlsConfig)
-	} else {
-		listener = inner
+	if c.HealthCheck.Interval > 0 {
+		health := c.HealthCheck
+		if health.Transport == "" {
+			// probe UDP-only server blocks over UDP
+			health.Transport = TransportTCP
+			if !c.ServesTCP() {
+				health.Transport = TransportUDP
+			}
+		}
+		for _, g := range s.upstreams.groups {
+			g.pool.health = &healthChecker{config: health, dialer: dialer}
+		}
+	}
+	s.metrics.Set("udp_sessions_active", expvar.Func(func() interface{} { return s.udpClients.Len() }))
+	s.metrics.Set("connections_active", expvar.Func(func() interface{} { return s.conns.Len() }))
+
+	return s, nil
+}
+
+// Address returns the address s listens on. It's prefixed with the
+// transport if s only listens on one, i.e. udp/:53.
+func (s *ProxyServer) Address() string {
+	return serverAddress(s.LocalTCPAddr, s.config)
+}
+
+// WrapListener returns ln as is, as proxy servers
+// don't have listener middleware
+func (s *ProxyServer) WrapListener(ln net.Listener) net.Listener {
+	return ln
+}
+
+// Listen starts listening by creating a new listener
+// and returning it. It does not start accepting
+// connections.
+func (s *ProxyServer) Listen() (net.Listener, error) {
+	if !s.config.ServesTCP() {
+		return nil, nil
 	}
 
-	return listener, nil
+	// TLS is added by Serve, so that the listener
+	// can be handed over to a new instance on a reload
+	return s.config.Socket.Listen(s.LocalTCPAddr)
 }
 
 // ListenPacket starts listening by creating a new Packet listener
 // and returning it. It does not start accepting
 // connections.
 func (s *ProxyServer) ListenPacket() (net.PacketConn, error) {
-	return net.ListenPacket("udp", fmt.Sprintf("%s", s.LocalTCPAddr))
+	if !s.config.ServesUDP() {
+		return nil, nil
+	}
+
+	return s.config.Socket.ListenPacket(s.LocalTCPAddr)
 
 }
 
@@ -68,112 +135,319 @@ func (s *ProxyServer) ListenPacket() (net.PacketConn, error) {
 // Serve blocks indefinitely, or in other
 // words, until the server is stopped.
 func (s *ProxyServer) Serve(ln net.Listener) error {
+	if ln == nil {
+		return nil
+	}
 
-	s.tcpListener = ln
-
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			return err
-		}
+	lns := s.config.Socket.listeners(ln, s.LocalTCPAddr, s.tlsConfig)
+	if !s.listeners.SetTCP(lns) {
+		// s was stopped before it started serving
+		return nil
+	}
+	s.upstreams.Start()
+	if s.prewarm != nil {
+		s.prewarm.Start()
+	}
 
-		p := &proxyConnection{
-			lconn:       conn,
-			laddr:       s.LocalTCPAddr,
-			raddr:       s.DestTCPAddr,
-			erred:       false,
-			closeSignal: make(chan bool),
-		}
+	return acceptLoops(lns, s.handle, s.metrics)
+}
 
-		go p.proxy()
+// handle proxies a connection accepted by Serve
+func (s *ProxyServer) handle(conn net.Conn) {
+	tc := s.conns.Add(conn)
+	group, addrs := s.pickUpstreams()
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &proxyConnection{
+		lconn:   tc,
+		laddr:   s.LocalTCPAddr,
+		raddrs:  addrs,
+		group:   group,
+		dialer:  s.dialer,
+		mirror:  s.mirror,
+		prewarm: s.prewarm,
+		faults:  s.pickFaults(),
+		ctx:     ctx,
+		cancel:  cancel,
 	}
+
+	go func() {
+		defer s.conns.Done(tc)
+		p.proxy()
+	}()
 }
 
 // ServePacket starts serving using the provided listener.
 // ServePacket blocks indefinitely, or in other
 // words, until the server is stopped.
 func (s *ProxyServer) ServePacket(con net.PacketConn) error {
+	if con == nil {
+		return nil
+	}
+
+	if !s.listeners.SetUDP(con) {
+		return nil
+	}
+	s.upstreams.Start()
+	if s.fanout != nil {
+		s.fanout.Start()
+	}
 
-	s.udpPacketConn = con
-	s.udpClientClosed = make(chan string)
+	bc := newBatchConn(con, s.config.UDP.BatchSize)
+	stop := make(chan struct{})
+	defer close(stop)
 
-	go s.handleClosedUDPConnections()
+	// Stop closes the sessions too, but the datagrams of the last
+	// batch may start sessions after it did
+	defer s.udpClients.CloseAll()
+	go s.writeUDPReplies(bc, stop)
 
-	buf := make([]byte, 4096)
+	// only closing the listener ends ServePacket, other errors are retried
+	var retry retryDelay
+	ds := newDatagrams(s.config.UDP.BatchSize, s.config.UDP.MaxDatagramSize)
 	for {
-		nr, addr, err := s.udpPacketConn.ReadFrom(buf)
+		n, err := bc.ReadBatch(ds)
 		if err != nil {
-			s.udpPacketConn.Close()
-		}
-
-		conn, found := s.udpClients[addr.String()]
-		if !found {
-			// Get remote server address
-			raddr, err := net.ResolveUDPAddr("udp", s.DestTCPAddr)
-			if err != nil {
-				return err
-			}
-
-			remoteUDPConn, err := net.DialUDP("udp", nil, raddr)
-			if err != nil {
+			if isClosed(err) {
 				return err
 			}
+			s.metrics.Add("udp_read_errors", 1)
+			retry.Wait(err, "Reading datagrams on %s", s.LocalTCPAddr)
+			continue
+		}
+		retry.Reset()
 
-			conn = &proxyUDPConnection{
-				lconn:     s.udpPacketConn,
-				laddr:     addr,
-				rconn:     remoteUDPConn,
-				closeChan: s.udpClientClosed,
+		for _, d := range ds[:n] {
+			if d.addr == nil {
+				s.metrics.Add("udp_read_errors", 1)
+				continue
 			}
+			s.proxyDatagram(d)
+		}
+	}
+}
 
-			s.udpClients[addr.String()] = conn
+// proxyDatagram queues a datagram received from a client for
+// the upstream, starting a new session if the client is new
+func (s *ProxyServer) proxyDatagram(d datagram) {
+	if s.dropDatagram() {
+		return
+	}
 
-			// wait for data from remote server
-			go conn.Wait()
+	addr := d.addr
+	conn := s.udpClients.Get(addr.String())
+	if conn == nil {
+		conn = newProxyUDPConnection(addr, d.local, s.udpReplies, s.config.UDP.QueueSize, s.config.UDP.IdleTimeout)
+		conn.closed = s.udpSessionClosed
+		conn.drop = s.dropDatagram
+
+		// make room for the new session by evicting the least recently used one
+		if evicted := s.udpClients.Add(addr.String(), conn); evicted != nil {
+			evicted.Close()
+			s.metrics.Add("udp_sessions_evicted", 1)
 		}
+		s.metrics.Add("udp_sessions_total", 1)
+
+		// connect to the remote server and wait for data from it,
+		// datagrams are queued in the meantime
+		_, addrs := s.pickUpstreams()
+		go conn.Wait(func() (*net.UDPConn, error) {
+			return s.dialer.DialUDP(context.Background(), addrs)
+		})
+	}
 
-		// proxy data received to remote server
-		_, err = conn.rconn.Write(buf[0:nr])
-		if err != nil {
-			return err
+	// queue the data received for the remote server, the buffer is
+	// copied because it's reused before the datagram is written
+	queued := make([]byte, d.n)
+	copy(queued, d.buf[:d.n])
+	if !conn.Send(queued) {
+		s.metrics.Add("udp_datagrams_dropped", 1)
+	}
+
+	// the copy is only read from, so it's shared with the fan-out
+	if s.fanout != nil {
+		s.fanout.Send(queued)
+	}
+}
+
+// pickUpstreams chooses the upstream group for a new connection or UDP
+// session, and returns its name if the traffic is split across groups
+// and the addresses to try
+func (s *ProxyServer) pickUpstreams() (string, []string) {
+	group, addrs := s.upstreams.Pick()
+	if !s.upstreams.Split() {
+		return "", addrs
+	}
+	s.metrics.Add("group_"+group+"_total", 1)
+	return group, addrs
+}
+
+// pickFaults chooses the faults injected into a new connection, if any
+func (s *ProxyServer) pickFaults() *connFaults {
+	f := s.faults.Pick()
+	if f == nil {
+		return nil
+	}
+	for _, t := range f.types {
+		s.metrics.Add("fault_"+t+"_total", 1)
+	}
+	return f
+}
+
+// dropDatagram returns true if a datagram, in either direction,
+// is to be dropped because of a drop fault
+func (s *ProxyServer) dropDatagram() bool {
+	if !s.faults.Drop() {
+		return false
+	}
+	s.metrics.Add("fault_"+FaultDrop+"_total", 1)
+	return true
+}
+
+// SetGroupWeight changes the share of the traffic the upstream group called
+// name gets, relative to the weights of the other groups. Groups start with
+// their percentage as weight. It applies to new connections and UDP sessions.
+func (s *ProxyServer) SetGroupWeight(name string, weight int) error {
+	return s.upstreams.SetWeight(name, weight)
+}
+
+// SetUpstreamWeight changes the weight of the upstream addr, or of all the
+// upstreams discovered from the destination addr, within its group.
+// It applies to new connections and UDP sessions.
+func (s *ProxyServer) SetUpstreamWeight(addr string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid weight %d for upstream %s", weight, addr)
+	}
+	if !s.upstreams.SetUpstreamWeight(addr, weight) {
+		return fmt.Errorf("unknown upstream %s", addr)
+	}
+	return nil
+}
+
+// AddUpstream adds the destination addr, in any of the forms of a
+// destination, to the upstream group called group with weight.
+// It applies to new connections and UDP sessions.
+func (s *ProxyServer) AddUpstream(group, addr string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid weight %d for upstream %s", weight, addr)
+	}
+	if !strings.HasPrefix(addr, srvPrefix) && !strings.HasPrefix(addr, filePrefix) {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid upstream %s: %v", addr, err)
 		}
 	}
+	return s.upstreams.AddUpstream(group, addr, weight)
+}
 
+// RemoveUpstream removes the destination addr from the upstream group called
+// group, or from every group if group is empty. It applies to new connections
+// and UDP sessions, the ones to its upstreams are left alone.
+func (s *ProxyServer) RemoveUpstream(group, addr string) error {
+	if !s.upstreams.RemoveUpstream(group, addr) {
+		return fmt.Errorf("unknown upstream %s", addr)
+	}
+	return nil
 }
 
-// handleClosedUDPConnections blocks and waits for udp closed connections and do cleanup
-func (s *ProxyServer) handleClosedUDPConnections() {
+// DrainUpstream drains the upstream addr, or all the upstreams discovered
+// from the destination addr, or undrains them. Drained upstreams get no new
+// connections or UDP sessions, the ones they have are left alone.
+func (s *ProxyServer) DrainUpstream(addr string, drained bool) error {
+	if !s.upstreams.SetUpstreamDrained(addr, drained) {
+		return fmt.Errorf("unknown upstream %s", addr)
+	}
+	return nil
+}
+
+// writeUDPReplies writes the datagrams the sessions received from the
+// upstream back to the clients, batching the replies that are ready
+// at the same time, until stop is closed
+func (s *ProxyServer) writeUDPReplies(bc batchConn, stop <-chan struct{}) {
+	batch := make([]datagram, 0, s.config.UDP.BatchSize)
 	for {
-		clientAddr := <-s.udpClientClosed
+		select {
+		case d := <-s.udpReplies:
+			batch = append(batch[:0], d)
+		case <-stop:
+			return
+		}
 
-		conn, found := s.udpClients[clientAddr]
-		if found {
-			conn.Close()
-			delete(s.udpClients, clientAddr)
+	fill:
+		for len(batch) < cap(batch) {
+			select {
+			case d := <-s.udpReplies:
+				batch = append(batch, d)
+			default:
+				break fill
+			}
+		}
+
+		if n, err := bc.WriteBatch(batch); err != nil {
+			s.metrics.Add("udp_write_errors", int64(len(batch)-n))
+		}
+		for _, d := range batch {
+			putUDPBuffer(d.buf)
 		}
 	}
 }
 
-// Stop stops s gracefully and closes its listener.
+// udpSessionClosed removes a closed UDP session from the session table
+func (s *ProxyServer) udpSessionClosed(p *proxyUDPConnection, idle bool) {
+	s.udpClients.Remove(p.laddr.String(), p)
+	if idle {
+		s.metrics.Add("udp_sessions_expired", 1)
+	}
+}
+
+// Stop stops s gracefully: it closes its listeners and waits for the live
+// TCP connections to finish, up to the grace period, before closing them.
+// UDP sessions are closed at once, as their replies go through the listener.
 func (s *ProxyServer) Stop() error {
+	err := s.listeners.Close()
+	s.udpClients.CloseAll()
 
-	err := s.tcpListener.Close()
-	if err != nil {
-		return err
+	if s.config.restarting() {
+		// the listeners have been handed over to the new instance,
+		// the connections of this one finish in the background
+		go s.finish()
+	} else {
+		s.finish()
 	}
 
-	s.udpPacketConn.Close()
-	if err != nil {
-		return err
-	}
+	return err
+}
 
-	return nil
+// finish drains the TCP connections and stops
+// the background work of a stopped server
+func (s *ProxyServer) finish() {
+	drain(s.Address(), s.conns, s.config.drainDeadline())
+
+	s.upstreams.Stop()
+	if s.fanout != nil {
+		s.fanout.Stop()
+	}
+	if s.prewarm != nil {
+		s.prewarm.Stop()
+	}
 }
 
 // OnStartupComplete lists the sites served by this server
 // and any relevant information
 func (s *ProxyServer) OnStartupComplete() {
 	if !caddy.Quiet {
-		fmt.Println("[INFO] Proxying from ", s.LocalTCPAddr, " -> ", s.DestTCPAddr)
+		fmt.Printf("[INFO] Proxying from %s -> %s (%s)\n", s.LocalTCPAddr, strings.Join(append([]string{s.DestTCPAddr}, s.config.Upstreams...), ", "), s.config.Transport)
+		if s.upstreams.Split() {
+			for _, g := range s.upstreams.groups {
+				fmt.Printf("[INFO] Splitting %d%% of the traffic from %s -> group %s\n", atomic.LoadInt32(&g.weight), s.LocalTCPAddr, g.name)
+			}
+		}
+		if s.config.Mirror.Addr != "" {
+			fmt.Printf("[INFO] Mirroring %g%% of the connections from %s -> %s\n", s.config.Mirror.Percent, s.LocalTCPAddr, s.config.Mirror.Addr)
+		}
+		if len(s.config.Fanout) > 0 {
+			fmt.Printf("[INFO] Copying datagrams from %s -> %s\n", s.LocalTCPAddr, strings.Join(s.config.Fanout, ", "))
+		}
+		for _, f := range s.config.Faults {
+			fmt.Printf("[INFO] Injecting %s faults into %g%% of the traffic of %s\n", f.Type, f.Probability, s.LocalTCPAddr)
+		}
 	}
 }
@@ -0,0 +1,349 @@
+package netserver
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startProxyServer starts a proxy server with the configuration c
+// which forwards the traffic to the upstream at dest
+func startProxyServer(t *testing.T, dest string, c *Config) (*ProxyServer, *testServer) {
+	t.Helper()
+
+	s, err := NewProxyServer("127.0.0.1:0", dest, c)
+	if err != nil {
+		t.Fatalf("NewProxyServer: %v", err)
+	}
+	return s, serve(t, s)
+}
+
+// metric returns the value of the counter called name in m,
+// which is 0 until it's first counted
+func metric(m *expvar.Map, name string) string {
+	if v := m.Get(name); v != nil {
+		return v.String()
+	}
+	return "0"
+}
+
+// eventually waits until cond returns true, and fails the test if it doesn't in time
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProxyServerTCP(t *testing.T) {
+	upstream, uts := startEchoServer(t, testConfig(TransportTCP))
+	defer func() {
+		upstream.Stop()
+		uts.wait(t)
+	}()
+
+	s, ts := startProxyServer(t, uts.tcpAddr, testConfig(TransportTCP))
+
+	concurrently(t, 32, func(client int) error {
+		conn, err := net.Dial("tcp", ts.tcpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		for i := 0; i < 10; i++ {
+			if err := roundTrip(conn, []byte(fmt.Sprintf("client %d message %d", client, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	ts.wait(t)
+	if n := s.conns.Len(); n != 0 {
+		t.Errorf("%d connections left after Stop", n)
+	}
+}
+
+// TestProxyServerUDPSessions sends datagrams from many clients at
+// once, each of which must only get the replies to its own datagrams
+func TestProxyServerUDPSessions(t *testing.T) {
+	upstream, uts := startEchoServer(t, testConfig(TransportUDP))
+	defer func() {
+		upstream.Stop()
+		uts.wait(t)
+	}()
+
+	s, ts := startProxyServer(t, uts.udpAddr, testConfig(TransportUDP))
+
+	const clients = 32
+	concurrently(t, clients, func(client int) error {
+		conn, err := net.Dial("udp", ts.udpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		for i := 0; i < 20; i++ {
+			if err := roundTrip(conn, []byte(fmt.Sprintf("client %d datagram %d", client, i))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if n := s.udpClients.Len(); n != clients {
+		t.Errorf("%d sessions, want %d", n, clients)
+	}
+	if total := metric(s.metrics, "udp_sessions_total"); total != fmt.Sprint(clients) {
+		t.Errorf("udp_sessions_total = %s, want %d", total, clients)
+	}
+
+	if err := s.Stop(); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	ts.wait(t)
+	eventually(t, "the sessions to close", func() bool { return s.udpClients.Len() == 0 })
+}
+
+// TestProxyServerUDPSessionLimit evicts the least recently
+// used sessions of concurrent clients beyond max_sessions
+func TestProxyServerUDPSessionLimit(t *testing.T) {
+	upstream, uts := startEchoServer(t, testConfig(TransportUDP))
+	defer func() {
+		upstream.Stop()
+		uts.wait(t)
+	}()
+
+	c := testConfig(TransportUDP)
+	c.UDP.MaxSessions = 8
+	s, ts := startProxyServer(t, uts.udpAddr, c)
+	defer func() {
+		s.Stop()
+		ts.wait(t)
+	}()
+
+	const clients = 32
+	concurrently(t, clients, func(client int) error {
+		conn, err := net.Dial("udp", ts.udpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// the datagram may be lost, or the session of the client evicted
+		// before the reply is relayed, so it's sent again until it's echoed
+		msg := []byte(fmt.Sprintf("client %d", client))
+		buf := make([]byte, len(msg))
+		for i := 0; i < 50; i++ {
+			if _, err := conn.Write(msg); err != nil {
+				return err
+			}
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if _, err := conn.Read(buf); err == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("no reply")
+	})
+
+	if n := s.udpClients.Len(); n != c.UDP.MaxSessions {
+		t.Errorf("%d sessions, want %d", n, c.UDP.MaxSessions)
+	}
+	total, _ := strconv.Atoi(metric(s.metrics, "udp_sessions_total"))
+	evicted, _ := strconv.Atoi(metric(s.metrics, "udp_sessions_evicted"))
+	if total < clients || evicted != total-c.UDP.MaxSessions {
+		t.Errorf("udp_sessions_total = %d and udp_sessions_evicted = %d, want at least %d and %d less", total, evicted, clients, c.UDP.MaxSessions)
+	}
+}
+
+func TestProxyServerUDPIdleTimeout(t *testing.T) {
+	upstream, uts := startEchoServer(t, testConfig(TransportUDP))
+	defer func() {
+		upstream.Stop()
+		uts.wait(t)
+	}()
+
+	c := testConfig(TransportUDP)
+	c.UDP.IdleTimeout = 100 * time.Millisecond
+	s, ts := startProxyServer(t, uts.udpAddr, c)
+	defer func() {
+		s.Stop()
+		ts.wait(t)
+	}()
+
+	conn, err := net.Dial("udp", ts.udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := roundTrip(conn, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the session to expire", func() bool { return s.udpClients.Len() == 0 })
+	if expired := metric(s.metrics, "udp_sessions_expired"); expired != "1" {
+		t.Errorf("udp_sessions_expired = %s, want 1", expired)
+	}
+
+	// a new session is started for the next datagram
+	if err := roundTrip(conn, []byte("hello again")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestProxyServerUDPStopWhileSending stops a server while clients
+// keep sending, which must not leave sessions behind
+func TestProxyServerUDPStopWhileSending(t *testing.T) {
+	upstream, uts := startEchoServer(t, testConfig(TransportUDP))
+	defer func() {
+		upstream.Stop()
+		uts.wait(t)
+	}()
+
+	s, ts := startProxyServer(t, uts.udpAddr, testConfig(TransportUDP))
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := net.Dial("udp", ts.udpAddr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn.Write([]byte("ping"))
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+
+	eventually(t, "sessions to be started", func() bool { return s.udpClients.Len() > 0 })
+	if err := s.Stop(); err != nil {
+		t.Errorf("Stop: %v", err)
+	}
+	ts.wait(t)
+	close(stop)
+	wg.Wait()
+
+	eventually(t, "the sessions to close", func() bool { return s.udpClients.Len() == 0 })
+}
+
+func TestProxyServerStopWhileStarting(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s, err := NewProxyServer("127.0.0.1:0", "127.0.0.1:9", testConfig(TransportBoth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln, err := s.Listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		pc, err := s.ListenPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ts := &testServer{errs: make(chan error, 2)}
+		go func() { ts.errs <- s.Serve(ln) }()
+		go func() { ts.errs <- s.ServePacket(pc) }()
+		if err := s.Stop(); err != nil && !isClosed(err) {
+			t.Errorf("Stop: %v", err)
+		}
+		ts.wait(t)
+
+		if _, err := ln.Accept(); err == nil || !isClosed(err) {
+			t.Errorf("TCP listener wasn't closed: %v", err)
+		}
+		if _, _, err := pc.ReadFrom(make([]byte, 1)); err == nil || !isClosed(err) {
+			t.Errorf("UDP listener wasn't closed: %v", err)
+		}
+	}
+}
+
+func TestUDPSessionTableConcurrent(t *testing.T) {
+	const max = 16
+	table := newUDPSessionTable("test", max)
+	replies := make(chan datagram)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1 + (g*500+i)%64}
+				key := addr.String()
+
+				p := table.Get(key)
+				if p == nil {
+					p = newProxyUDPConnection(addr, nil, replies, 1, 0)
+					if evicted := table.Add(key, p); evicted != nil {
+						evicted.Close()
+					}
+				}
+				if i%3 == 0 {
+					table.Remove(key, p)
+				}
+				if n := table.Len(); n > max {
+					t.Errorf("%d sessions, want at most %d", n, max)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	table.CloseAll()
+	if n := table.Len(); n != 0 {
+		t.Errorf("%d sessions left after CloseAll", n)
+	}
+}
+
+// TestProxyUDPConnectionQueueFull drops and counts the datagrams
+// that don't fit in the queue of a session, without blocking
+func TestProxyUDPConnectionQueueFull(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	p := newProxyUDPConnection(addr, nil, make(chan datagram), 2, 0)
+	defer p.Close()
+
+	sent := 0
+	for i := 0; i < 5; i++ {
+		if p.Send([]byte(strings.Repeat("x", i))) {
+			sent++
+		}
+	}
+	if sent != 2 {
+		t.Errorf("queued %d datagrams, want 2", sent)
+	}
+	if dropped := atomic.LoadInt64(&p.dropped); dropped != 3 {
+		t.Errorf("dropped %d datagrams, want 3", dropped)
+	}
+	if v := newSessionView("test", p); v.Dropped != 3 {
+		t.Errorf("the admin API reports %d dropped datagrams, want 3", v.Dropped)
+	}
+}
@@ -0,0 +1,234 @@
+package netserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultResolverTTL is used for lookups through the system
+	// resolver, which doesn't expose the TTL of records
+	defaultResolverTTL = 30 * time.Second
+
+	// minResolverTTL keeps records with a very low or zero TTL from
+	// causing a lookup for every connection
+	minResolverTTL = time.Second
+)
+
+// ResolverConfig contains the settings of the resolver
+// used to look up the addresses of upstream servers
+type ResolverConfig struct {
+	// DNS servers to query, the system resolver is used if empty
+	Servers []string
+
+	// Bounds applied to the TTL of looked up records
+	MinTTL time.Duration
+	MaxTTL time.Duration
+}
+
+// resolver looks up upstream hostnames and caches
+// the results for the TTL of the records
+type resolver struct {
+	config ResolverConfig
+	client *dns.Client
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// newResolver returns a resolver for the settings in c
+func newResolver(c ResolverConfig) *resolver {
+	return &resolver{
+		config: c,
+		client: &dns.Client{},
+		cache:  make(map[string]cacheEntry),
+	}
+}
+
+// LookupIP returns the IPv4 and IPv6 addresses of host
+// and the time until they should be looked up again
+func (r *resolver) LookupIP(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+
+	key := "ip:" + strings.ToLower(host)
+	if v, ttl, ok := r.cached(key); ok {
+		return v.([]net.IP), ttl, nil
+	}
+
+	var ips []net.IP
+	var ttl time.Duration
+	if len(r.config.Servers) == 0 {
+		ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, ipAddr := range ipAddrs {
+			ips = append(ips, ipAddr.IP)
+		}
+		ttl = defaultResolverTTL
+	} else {
+		var errs []string
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			rrs, rrTTL, err := r.query(ctx, host, qtype)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			for _, rr := range rrs {
+				switch rr := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rr.A)
+				case *dns.AAAA:
+					ips = append(ips, rr.AAAA)
+				}
+			}
+			if len(rrs) > 0 && (ttl == 0 || rrTTL < ttl) {
+				ttl = rrTTL
+			}
+		}
+		if len(ips) == 0 {
+			if len(errs) > 0 {
+				return nil, 0, fmt.Errorf("looking up %s: %s", host, strings.Join(errs, "; "))
+			}
+			return nil, 0, fmt.Errorf("looking up %s: no addresses found", host)
+		}
+	}
+
+	ttl = r.clampTTL(ttl)
+	r.store(key, ips, ttl)
+
+	return ips, ttl, nil
+}
+
+// LookupSRV returns the SRV records of name, i.e _db._tcp.service.internal,
+// and the time until they should be looked up again
+func (r *resolver) LookupSRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	key := "srv:" + strings.ToLower(name)
+	if v, ttl, ok := r.cached(key); ok {
+		return v.([]*net.SRV), ttl, nil
+	}
+
+	var srvs []*net.SRV
+	var ttl time.Duration
+	if len(r.config.Servers) == 0 {
+		var err error
+		_, srvs, err = net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if err != nil {
+			return nil, 0, err
+		}
+		ttl = defaultResolverTTL
+	} else {
+		rrs, rrTTL, err := r.query(ctx, name, dns.TypeSRV)
+		if err != nil {
+			return nil, 0, fmt.Errorf("looking up %s: %v", name, err)
+		}
+		for _, rr := range rrs {
+			if rr, ok := rr.(*dns.SRV); ok {
+				srvs = append(srvs, &net.SRV{
+					Target:   strings.TrimSuffix(rr.Target, "."),
+					Port:     rr.Port,
+					Priority: rr.Priority,
+					Weight:   rr.Weight,
+				})
+			}
+		}
+		ttl = rrTTL
+	}
+
+	if len(srvs) == 0 {
+		return nil, 0, fmt.Errorf("looking up %s: no SRV records found", name)
+	}
+
+	ttl = r.clampTTL(ttl)
+	r.store(key, srvs, ttl)
+
+	return srvs, ttl, nil
+}
+
+// query sends a question for name to the configured servers, in
+// order, and returns the answer of the first server that responds
+// along with the lowest TTL of the returned records
+func (r *resolver) query(ctx context.Context, name string, qtype uint16) ([]dns.RR, time.Duration, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+
+	var err error
+	for _, server := range r.config.Servers {
+		var resp *dns.Msg
+		resp, _, err = r.client.ExchangeContext(ctx, m, server)
+		if err != nil {
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("%s returned %s for %s", server, dns.RcodeToString[resp.Rcode], name)
+			continue
+		}
+
+		var rrs []dns.RR
+		var ttl time.Duration
+		for _, rr := range resp.Answer {
+			if rr.Header().Rrtype != qtype {
+				// skip CNAMEs leading to the requested records
+				continue
+			}
+			rrTTL := time.Duration(rr.Header().Ttl) * time.Second
+			if len(rrs) == 0 || rrTTL < ttl {
+				ttl = rrTTL
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs, ttl, nil
+	}
+
+	return nil, 0, err
+}
+
+// clampTTL applies the configured minimum and maximum TTL to ttl
+func (r *resolver) clampTTL(ttl time.Duration) time.Duration {
+	if r.config.MinTTL > 0 && ttl < r.config.MinTTL {
+		ttl = r.config.MinTTL
+	}
+	if r.config.MaxTTL > 0 && ttl > r.config.MaxTTL {
+		ttl = r.config.MaxTTL
+	}
+	if ttl < minResolverTTL {
+		ttl = minResolverTTL
+	}
+	return ttl
+}
+
+func (r *resolver) cached(key string) (interface{}, time.Duration, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.cache[key]
+	if !ok {
+		return nil, 0, false
+	}
+	ttl := time.Until(e.expires)
+	if ttl <= 0 {
+		delete(r.cache, key)
+		return nil, 0, false
+	}
+	return e.value, ttl, true
+}
+
+func (r *resolver) store(key string, value interface{}, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cache[key] = cacheEntry{value: value, expires: time.Now().Add(ttl)}
+}
@@ -0,0 +1,257 @@
+package netserver
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testDNSServer is an authoritative DNS server on the loopback
+// interface whose records can be changed while it's running
+type testDNSServer struct {
+	addr   string
+	server *dns.Server
+
+	mu      sync.Mutex
+	records []dns.RR
+	rcode   int
+	queries int
+}
+
+// startDNSServer starts a DNS server answering with records
+func startDNSServer(t *testing.T, records ...string) *testDNSServer {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testDNSServer{addr: pc.LocalAddr().String()}
+	s.SetRecords(t, records...)
+	s.server = &dns.Server{PacketConn: pc, Handler: s}
+	go s.server.ActivateAndServe()
+	return s
+}
+
+// SetRecords replaces the records of s and makes it answer successfully
+func (s *testDNSServer) SetRecords(t *testing.T, records ...string) {
+	t.Helper()
+
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rrs = append(rrs, rr)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records, s.rcode = rrs, dns.RcodeSuccess
+}
+
+// Fail makes s answer all questions with rcode
+func (s *testDNSServer) Fail(rcode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rcode = rcode
+}
+
+// Queries returns the number of questions s answered
+func (s *testDNSServer) Queries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func (s *testDNSServer) Close() {
+	s.server.Shutdown()
+}
+
+func (s *testDNSServer) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queries++
+	m := new(dns.Msg)
+	m.SetRcode(req, s.rcode)
+	q := req.Question[0]
+	if s.rcode == dns.RcodeSuccess {
+		for _, rr := range s.records {
+			if rr.Header().Rrtype == q.Qtype && strings.EqualFold(rr.Header().Name, q.Name) {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+	}
+	w.WriteMsg(m)
+}
+
+func TestResolverLookupIPTTL(t *testing.T) {
+	s := startDNSServer(t,
+		"upstream.test. 1 IN A 10.0.0.1",
+		"upstream.test. 2 IN AAAA fd00::1",
+	)
+	defer s.Close()
+	r := newResolver(ResolverConfig{Servers: []string{s.addr}})
+	ctx := context.Background()
+
+	ips, ttl, err := r.LookupIP(ctx, "upstream.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.1")) || !ips[1].Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("got %v, want [10.0.0.1 fd00::1]", ips)
+	}
+	// the addresses are looked up again once the first record expires
+	if ttl != time.Second {
+		t.Errorf("TTL = %v, want 1s", ttl)
+	}
+
+	// the cached addresses are returned until they expire
+	s.SetRecords(t,
+		"upstream.test. 1 IN A 10.0.0.2",
+		"upstream.test. 1 IN AAAA fd00::2",
+	)
+	queries := s.Queries()
+	ips, _, err = r.LookupIP(ctx, "upstream.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Queries() != queries || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("got %v from %d new queries, want the cached addresses", ips, s.Queries()-queries)
+	}
+
+	time.Sleep(ttl + 100*time.Millisecond)
+	ips, _, err = r.LookupIP(ctx, "upstream.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("10.0.0.2")) || !ips[1].Equal(net.ParseIP("fd00::2")) {
+		t.Errorf("got %v after the TTL, want [10.0.0.2 fd00::2]", ips)
+	}
+}
+
+func TestResolverClampTTL(t *testing.T) {
+	s := startDNSServer(t,
+		"short.test. 0 IN A 10.0.0.1",
+		"long.test. 86400 IN A 10.0.0.2",
+	)
+	defer s.Close()
+
+	tests := []struct {
+		host           string
+		minTTL, maxTTL time.Duration
+		want           time.Duration
+	}{
+		{host: "short.test", want: minResolverTTL},
+		{host: "short.test", minTTL: 10 * time.Second, want: 10 * time.Second},
+		{host: "long.test", want: 86400 * time.Second},
+		{host: "long.test", maxTTL: time.Minute, want: time.Minute},
+	}
+	for _, test := range tests {
+		r := newResolver(ResolverConfig{Servers: []string{s.addr}, MinTTL: test.minTTL, MaxTTL: test.maxTTL})
+		_, ttl, err := r.LookupIP(context.Background(), test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl != test.want {
+			t.Errorf("%s with min %v and max %v: TTL = %v, want %v", test.host, test.minTTL, test.maxTTL, ttl, test.want)
+		}
+	}
+}
+
+// TestResolverSRVOrder balances between the targets with the
+// best priority by their weight, and falls back to the others
+func TestResolverSRVOrder(t *testing.T) {
+	s := startDNSServer(t,
+		"_db._tcp.test. 60 IN SRV 10 1 5432 a.test.",
+		"_db._tcp.test. 60 IN SRV 10 3 5432 b.test.",
+		"_db._tcp.test. 60 IN SRV 20 5 5432 c.test.",
+	)
+	defer s.Close()
+
+	r := newResolver(ResolverConfig{Servers: []string{s.addr}})
+	p := newUpstreamPool([]string{"srv+_db._tcp.test"}, nil, r)
+	p.Start()
+	defer p.Stop()
+	eventually(t, "the SRV records to be discovered", func() bool { return len(p.Addrs()) > 0 })
+
+	picked := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		addrs := p.Addrs()
+		if len(addrs) != 3 {
+			t.Fatalf("got %v, want 3 addresses", addrs)
+		}
+		picked[addrs[0]]++
+
+		// the other target of priority 10 comes before c.test
+		if addrs[2] != "c.test:5432" {
+			t.Errorf("got %v, want c.test:5432 last", addrs)
+		}
+	}
+	if picked["a.test:5432"] != 10 || picked["b.test:5432"] != 30 {
+		t.Errorf("picked %v, want a.test 10 and b.test 30 times", picked)
+	}
+}
+
+func TestResolverServerFailure(t *testing.T) {
+	s := startDNSServer(t, "upstream.test. 60 IN A 10.0.0.1")
+	defer s.Close()
+	ctx := context.Background()
+
+	s.Fail(dns.RcodeServerFailure)
+	r := newResolver(ResolverConfig{Servers: []string{s.addr}})
+	if _, _, err := r.LookupIP(ctx, "upstream.test"); err == nil || !strings.Contains(err.Error(), "SERVFAIL") {
+		t.Errorf("got %v, want SERVFAIL", err)
+	}
+	if _, _, err := r.LookupSRV(ctx, "_db._tcp.test"); err == nil || !strings.Contains(err.Error(), "SERVFAIL") {
+		t.Errorf("got %v, want SERVFAIL", err)
+	}
+
+	// a server that doesn't respond is skipped
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := pc.LocalAddr().String()
+	pc.Close()
+
+	s.SetRecords(t, "upstream.test. 60 IN A 10.0.0.1")
+	r = newResolver(ResolverConfig{Servers: []string{down, s.addr}})
+	ips, _, err := r.LookupIP(ctx, "upstream.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("got %v, want [10.0.0.1]", ips)
+	}
+}
+
+// TestResolverServerFailureKeepsUpstreams keeps the upstreams
+// discovered last while the DNS server fails
+func TestResolverServerFailureKeepsUpstreams(t *testing.T) {
+	s := startDNSServer(t, "upstream.test. 1 IN A 10.0.0.1")
+	defer s.Close()
+
+	r := newResolver(ResolverConfig{Servers: []string{s.addr}})
+	p := newUpstreamPool([]string{"upstream.test:80"}, nil, r)
+	p.Start()
+	defer p.Stop()
+	eventually(t, "the addresses to be discovered", func() bool {
+		addrs := p.Addrs()
+		return len(addrs) == 1 && addrs[0] == "10.0.0.1:80"
+	})
+
+	s.Fail(dns.RcodeServerFailure)
+	queries := s.Queries()
+	eventually(t, "the addresses to be looked up again", func() bool { return s.Queries() > queries })
+	if addrs := p.Addrs(); len(addrs) != 1 || addrs[0] != "10.0.0.1:80" {
+		t.Errorf("got %v, want [10.0.0.1:80]", addrs)
+	}
+}
@@ -0,0 +1,76 @@
+package netserver
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// SocketConfig contains the socket options of the listeners
+// of a server block and of the connections to its upstreams
+type SocketConfig struct {
+	// TCP keepalive period, the Go default if 0 and disabled if negative
+	KeepAlive time.Duration
+
+	// NoDelay disables Nagle's algorithm on TCP connections, as Go does by default
+	NoDelay bool
+
+	// Number of TCP listeners sharing the address through SO_REUSEPORT,
+	// each with its own accept loop. SO_REUSEPORT isn't set if it's 0.
+	ReusePort int
+
+	// FastOpen enables TCP Fast Open for listeners and upstream dials
+	FastOpen bool
+
+	// MPTCP enables Multipath TCP where the kernel supports it
+	MPTCP bool
+
+	// Sizes of the socket buffers, the system default if 0
+	SendBuffer    int
+	ReceiveBuffer int
+}
+
+// Listen returns a TCP listener on addr with the socket options of c
+func (c SocketConfig) Listen(addr string) (net.Listener, error) {
+	lc := &net.ListenConfig{KeepAlive: c.KeepAlive, Control: c.control(true)}
+	setMultipathTCP(lc, nil, c.MPTCP)
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+// ListenPacket returns a UDP packet connection on addr with the socket options of c
+func (c SocketConfig) ListenPacket(addr string) (net.PacketConn, error) {
+	lc := &net.ListenConfig{Control: c.control(true)}
+	return lc.ListenPacket(context.Background(), "udp", addr)
+}
+
+// Dialer returns a dialer for upstream connections with the socket options of c
+func (c SocketConfig) Dialer() *net.Dialer {
+	d := &net.Dialer{KeepAlive: c.KeepAlive, Control: c.control(false)}
+	setMultipathTCP(nil, d, c.MPTCP)
+	return d
+}
+
+// Apply sets the options of c that Go overrides once a TCP
+// connection is established on conn, which is accepted or dialed
+func (c SocketConfig) Apply(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok && !c.NoDelay {
+		tc.SetNoDelay(false)
+	}
+}
+
+// socketListener is a TCP listener which applies the options of
+// its SocketConfig to the connections it accepts. It wraps the
+// listener below TLS, where the connections are still TCP.
+type socketListener struct {
+	net.Listener
+	config SocketConfig
+}
+
+func (ln *socketListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ln.config.Apply(conn)
+	return conn, nil
+}
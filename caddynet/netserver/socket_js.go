@@ -0,0 +1,20 @@
+//go:build js
+// +build js
+
+package netserver
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// control returns the function setting the options of c on a socket
+// before it's bound or connected. js/wasm has no socket options.
+func (c SocketConfig) control(listen bool) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		if c.SendBuffer > 0 || c.ReceiveBuffer > 0 {
+			return fmt.Errorf("socket buffer sizes aren't supported on js")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,58 @@
+//go:build linux
+// +build linux
+
+package netserver
+
+import (
+	"syscall"
+)
+
+// Linux socket options missing from package syscall
+const (
+	soReusePort        = 0xf
+	tcpFastOpen        = 0x17
+	tcpFastOpenConnect = 0x1e
+)
+
+// fastOpenQueueLen is the number of pending TCP Fast Open
+// connections a listener accepts before falling back to TCP
+const fastOpenQueueLen = 256
+
+// control returns the function setting the options of c on a socket
+// before it's bound or connected, for listening if listen is true
+func (c SocketConfig) control(listen bool) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		tcp := network == "tcp" || network == "tcp4" || network == "tcp6"
+
+		var err error
+		set := func(level, opt, value int) {
+			if err != nil {
+				return
+			}
+			if cerr := rc.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), level, opt, value)
+			}); cerr != nil {
+				err = cerr
+			}
+		}
+
+		// only TCP listeners are opened more than once, a single UDP
+		// socket with SO_REUSEPORT would let others share its port
+		if c.ReusePort > 0 && tcp && listen {
+			set(syscall.SOL_SOCKET, soReusePort, 1)
+		}
+		if c.SendBuffer > 0 {
+			set(syscall.SOL_SOCKET, syscall.SO_SNDBUF, c.SendBuffer)
+		}
+		if c.ReceiveBuffer > 0 {
+			set(syscall.SOL_SOCKET, syscall.SO_RCVBUF, c.ReceiveBuffer)
+		}
+		if c.FastOpen && tcp && listen {
+			set(syscall.IPPROTO_TCP, tcpFastOpen, fastOpenQueueLen)
+		}
+		if c.FastOpen && tcp && !listen {
+			set(syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+		}
+		return err
+	}
+}
@@ -0,0 +1,110 @@
+//go:build linux
+// +build linux
+
+package netserver
+
+import (
+	"crypto/tls"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// recordingListener records the connections it accepts
+type recordingListener struct {
+	net.Listener
+	accepted chan net.Conn
+}
+
+func (ln *recordingListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err == nil {
+		ln.accepted <- conn
+	}
+	return conn, err
+}
+
+// sockopt returns the value of the option opt of the socket of conn
+func sockopt(t *testing.T, conn syscall.Conn, level, opt int) int {
+	t.Helper()
+
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	if cerr := rc.Control(func(fd uintptr) {
+		v, err = syscall.GetsockoptInt(int(fd), level, opt)
+	}); cerr != nil {
+		t.Fatal(cerr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// noDelay returns whether TCP_NODELAY is set on conn
+func noDelay(t *testing.T, conn net.Conn) bool {
+	t.Helper()
+	return sockopt(t, conn.(*net.TCPConn), syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0
+}
+
+// TestSocketListenersNoDelay applies nodelay to the connections
+// accepted by the listeners of a server block, with and without TLS
+func TestSocketListenersNoDelay(t *testing.T) {
+	for _, tlsConfig := range []*tls.Config{nil, {}} {
+		for _, nodelay := range []bool{true, false} {
+			c := SocketConfig{NoDelay: nodelay}
+			ln, err := c.Listen("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw := &recordingListener{Listener: ln, accepted: make(chan net.Conn, 1)}
+			lns := c.listeners(raw, ln.Addr().String(), tlsConfig)
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn, err := lns[0].Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := conn.(*tls.Conn); ok != (tlsConfig != nil) {
+				t.Errorf("tls %v: accepted a %T", tlsConfig != nil, conn)
+			}
+			if got := noDelay(t, <-raw.accepted); got != nodelay {
+				t.Errorf("tls %v, nodelay %v: TCP_NODELAY is %v", tlsConfig != nil, nodelay, got)
+			}
+
+			conn.Close()
+			client.Close()
+			closeListeners(lns)
+		}
+	}
+}
+
+// TestSocketReusePortTCPOnly sets SO_REUSEPORT on TCP listeners, which
+// are opened more than once, but not on the single UDP socket
+func TestSocketReusePortTCPOnly(t *testing.T) {
+	c := SocketConfig{ReusePort: 2}
+
+	ln, err := c.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if v := sockopt(t, ln.(*net.TCPListener), syscall.SOL_SOCKET, soReusePort); v == 0 {
+		t.Error("SO_REUSEPORT isn't set on the TCP listener")
+	}
+
+	pc, err := c.ListenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if v := sockopt(t, pc.(*net.UDPConn), syscall.SOL_SOCKET, soReusePort); v != 0 {
+		t.Error("SO_REUSEPORT is set on the UDP socket")
+	}
+}
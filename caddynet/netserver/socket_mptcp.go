@@ -0,0 +1,17 @@
+//go:build go1.21
+// +build go1.21
+
+package netserver
+
+import "net"
+
+// setMultipathTCP enables Multipath TCP on lc or d, which may be nil.
+// Go falls back to TCP if the kernel doesn't support it.
+func setMultipathTCP(lc *net.ListenConfig, d *net.Dialer, enabled bool) {
+	if lc != nil {
+		lc.SetMultipathTCP(enabled)
+	}
+	if d != nil {
+		d.SetMultipathTCP(enabled)
+	}
+}
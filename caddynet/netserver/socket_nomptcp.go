@@ -0,0 +1,17 @@
+//go:build !go1.21
+// +build !go1.21
+
+package netserver
+
+import (
+	"log"
+	"net"
+)
+
+// setMultipathTCP logs that Multipath TCP isn't supported by
+// this version of Go if it's enabled, which falls back to TCP
+func setMultipathTCP(lc *net.ListenConfig, d *net.Dialer, enabled bool) {
+	if enabled {
+		log.Printf("[WARNING] Multipath TCP requires Go 1.21, falling back to TCP")
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux && !js
+// +build !linux,!js
+
+package netserver
+
+import (
+	"syscall"
+)
+
+// control returns the function setting the options of c on a socket before
+// it's bound or connected. Only the buffer sizes are supported outside of
+// Linux, the socket directive rejects reuseport and fastopen.
+func (c SocketConfig) control(listen bool) func(network, address string, rc syscall.RawConn) error {
+	return func(network, address string, rc syscall.RawConn) error {
+		var err error
+		set := func(opt, value int) {
+			if err != nil || value <= 0 {
+				return
+			}
+			if cerr := rc.Control(func(fd uintptr) {
+				err = setsockoptInt(fd, syscall.SOL_SOCKET, opt, value)
+			}); cerr != nil {
+				err = cerr
+			}
+		}
+
+		set(syscall.SO_SNDBUF, c.SendBuffer)
+		set(syscall.SO_RCVBUF, c.ReceiveBuffer)
+		return err
+	}
+}
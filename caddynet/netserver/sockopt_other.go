@@ -0,0 +1,11 @@
+//go:build !linux && !windows && !js
+// +build !linux,!windows,!js
+
+package netserver
+
+import "syscall"
+
+// setsockoptInt sets the option opt of the socket fd to value
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(int(fd), level, opt, value)
+}
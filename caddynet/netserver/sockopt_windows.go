@@ -0,0 +1,11 @@
+//go:build windows
+// +build windows
+
+package netserver
+
+import "syscall"
+
+// setsockoptInt sets the option opt of the socket fd to value
+func setsockoptInt(fd uintptr, level, opt, value int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), level, opt, value)
+}
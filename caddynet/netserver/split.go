@@ -0,0 +1,205 @@
+package netserver
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultGroup is the name of the upstream group made up of the
+// destination of a proxy server block and its upstream directive
+const DefaultGroup = "default"
+
+// UpstreamGroup is a named set of upstreams that
+// gets a share of the traffic of a proxy server block
+type UpstreamGroup struct {
+	Name string
+
+	// Percentage of the connections and UDP sessions sent to the group
+	Percent int
+
+	// Addresses of the group, in any of the forms of a destination
+	Upstreams []string
+}
+
+// upstreamGroup is an UpstreamGroup with its pool of upstreams
+type upstreamGroup struct {
+	name   string
+	weight int32 // accessed atomically
+	pool   *upstreamPool
+}
+
+// upstreamSplit splits the traffic of a proxy server across upstream
+// groups according to their weights, which can be changed at any time
+type upstreamSplit struct {
+	groups []*upstreamGroup
+}
+
+// newUpstreamSplit returns a split with the default group made up
+// of dests and the groups of c, each with their own pool. The default
+// group gets the percentage the other groups leave.
+func newUpstreamSplit(dests []string, c *Config) *upstreamSplit {
+	rest := 100
+	for _, g := range c.Groups {
+		rest -= g.Percent
+	}
+	if rest < 0 {
+		rest = 0
+	}
+
+	s := &upstreamSplit{}
+	s.add(DefaultGroup, rest, dests, c)
+	for _, g := range c.Groups {
+		s.add(g.Name, g.Percent, g.Upstreams, c)
+	}
+	return s
+}
+
+func (s *upstreamSplit) add(name string, weight int, dests []string, c *Config) {
+	pool := newUpstreamPool(dests, c.Weights, c.resolver)
+	s.groups = append(s.groups, &upstreamGroup{name: name, weight: int32(weight), pool: pool})
+}
+
+// Split returns true if the traffic is split across more than one group
+func (s *upstreamSplit) Split() bool {
+	return len(s.groups) > 1
+}
+
+// Pick chooses the group for a new connection or UDP session by
+// weighted random choice, and returns its name and the addresses
+// to try. When the chosen group has no addresses, for instance
+// before its SRV records have been looked up, the addresses of
+// the first other group that has any are used.
+func (s *upstreamSplit) Pick() (string, []string) {
+	picked := s.groups[0]
+
+	total := 0
+	for _, g := range s.groups {
+		total += int(atomic.LoadInt32(&g.weight))
+	}
+	if total > 0 {
+		n := rand.Intn(total)
+		for _, g := range s.groups {
+			n -= int(atomic.LoadInt32(&g.weight))
+			if n < 0 {
+				picked = g
+				break
+			}
+		}
+	}
+
+	if addrs := picked.pool.Addrs(); len(addrs) > 0 {
+		return picked.name, addrs
+	}
+	for _, g := range s.groups {
+		if g == picked {
+			continue
+		}
+		if addrs := g.pool.Addrs(); len(addrs) > 0 {
+			return g.name, addrs
+		}
+	}
+	return picked.name, nil
+}
+
+// SetWeight changes the weight of the group called name
+func (s *upstreamSplit) SetWeight(name string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("invalid weight %d for group %s", weight, name)
+	}
+	for _, g := range s.groups {
+		if g.name == name {
+			atomic.StoreInt32(&g.weight, int32(weight))
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown upstream group %s", name)
+}
+
+// SetUpstreamWeight changes the weight of the upstream addr in
+// every group it's in, and returns false if there is no such upstream
+func (s *upstreamSplit) SetUpstreamWeight(addr string, weight int) bool {
+	found := false
+	for _, g := range s.groups {
+		if g.pool.SetWeight(addr, weight) {
+			found = true
+		}
+	}
+	return found
+}
+
+// AddUpstream adds the destination addr to the group called name
+func (s *upstreamSplit) AddUpstream(name, addr string, weight int) error {
+	g := s.group(name)
+	if g == nil {
+		return fmt.Errorf("unknown upstream group %s", name)
+	}
+	return g.pool.Add(addr, weight)
+}
+
+// RemoveUpstream removes the destination addr from the group called
+// name, or from every group it's in if name is empty, and returns
+// false if there is no such destination
+func (s *upstreamSplit) RemoveUpstream(name, addr string) bool {
+	found := false
+	for _, g := range s.groups {
+		if (name == "" || g.name == name) && g.pool.Remove(addr) {
+			found = true
+		}
+	}
+	return found
+}
+
+// SetUpstreamDrained drains or undrains the upstream addr in every
+// group it's in, and returns false if there is no such upstream
+func (s *upstreamSplit) SetUpstreamDrained(addr string, drained bool) bool {
+	found := false
+	for _, g := range s.groups {
+		if g.pool.SetDrained(addr, drained) {
+			found = true
+		}
+	}
+	return found
+}
+
+// Active returns the addresses of the upstreams of all
+// groups that aren't drained, which may contain duplicates
+func (s *upstreamSplit) Active() []string {
+	var addrs []string
+	for _, g := range s.groups {
+		addrs = append(addrs, g.pool.active()...)
+	}
+	return addrs
+}
+
+// group returns the group called name, or nil
+func (s *upstreamSplit) group(name string) *upstreamGroup {
+	for _, g := range s.groups {
+		if g.name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// Start starts the pools of all groups, and returns
+// once their first discovery of upstreams is done
+func (s *upstreamSplit) Start() {
+	var wg sync.WaitGroup
+	for _, g := range s.groups {
+		wg.Add(1)
+		go func(g *upstreamGroup) {
+			defer wg.Done()
+			g.pool.Start()
+		}(g)
+	}
+	wg.Wait()
+}
+
+// Stop stops the pools of all groups
+func (s *upstreamSplit) Stop() {
+	for _, g := range s.groups {
+		g.pool.Stop()
+	}
+}
@@ -0,0 +1,143 @@
+package netserver
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// udpSessionTable holds the UDP proxy sessions of a server keyed by
+// client address. When the table is full the least recently used
+// session is evicted to make room for a new client. It's safe for
+// concurrent use by the read loop of the server and the goroutines
+// of the sessions.
+type udpSessionTable struct {
+	server string
+
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	lru      *list.List // most recently used at the front
+	max      int
+}
+
+// newUDPSessionTable returns a table for the server at addr holding at
+// most max sessions, or an unlimited number of sessions if max is 0
+func newUDPSessionTable(addr string, max int) *udpSessionTable {
+	return &udpSessionTable{
+		server:   addr,
+		sessions: make(map[string]*list.Element),
+		lru:      list.New(),
+		max:      max,
+	}
+}
+
+// Get returns the session of the client at key and marks it
+// as most recently used. It returns nil if there is none.
+func (t *udpSessionTable) Get(key string) *proxyUDPConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.sessions[key]
+	if !ok {
+		return nil
+	}
+	t.lru.MoveToFront(e)
+	return e.Value.(*proxyUDPConnection)
+}
+
+// Add adds the session p for the client at key. If the table
+// is full the least recently used session is removed from the
+// table and returned so that it can be closed.
+func (t *udpSessionTable) Add(key string, p *proxyUDPConnection) *proxyUDPConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var evicted *proxyUDPConnection
+	if t.max > 0 && t.lru.Len() >= t.max {
+		if e := t.lru.Back(); e != nil {
+			evicted = e.Value.(*proxyUDPConnection)
+			t.lru.Remove(e)
+			delete(t.sessions, evicted.laddr.String())
+		}
+	}
+
+	t.sessions[key] = t.lru.PushFront(p)
+	return evicted
+}
+
+// Remove removes the session of the client at key, but only if it is
+// still p: an evicted session must not remove its replacement
+func (t *udpSessionTable) Remove(key string, p *proxyUDPConnection) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.sessions[key]
+	if !ok || e.Value.(*proxyUDPConnection) != p {
+		return false
+	}
+	t.lru.Remove(e)
+	delete(t.sessions, key)
+	return true
+}
+
+// Len returns the number of sessions in the table
+func (t *udpSessionTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.lru.Len()
+}
+
+// List returns the sessions in the table, most recently used first
+func (t *udpSessionTable) List() []*proxyUDPConnection {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sessions := make([]*proxyUDPConnection, 0, t.lru.Len())
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		sessions = append(sessions, e.Value.(*proxyUDPConnection))
+	}
+	return sessions
+}
+
+// Close closes the session with the given ID, and returns false if
+// there is none. The session removes itself from the table.
+func (t *udpSessionTable) Close(id uint64) bool {
+	for _, p := range t.List() {
+		if p.id == id {
+			p.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// CloseFrom closes the sessions of clients with the IP ip
+// and returns how many there were
+func (t *udpSessionTable) CloseFrom(ip net.IP) int {
+	n := 0
+	for _, p := range t.List() {
+		if addr, ok := p.laddr.(*net.UDPAddr); ok && addr.IP.Equal(ip) {
+			p.Close()
+			n++
+		}
+	}
+	return n
+}
+
+// CloseAll closes and removes all sessions
+func (t *udpSessionTable) CloseAll() {
+	t.mu.Lock()
+	sessions := make([]*proxyUDPConnection, 0, t.lru.Len())
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		sessions = append(sessions, e.Value.(*proxyUDPConnection))
+	}
+	t.sessions = make(map[string]*list.Element)
+	t.lru.Init()
+	t.mu.Unlock()
+
+	// close outside the lock, closed sessions remove themselves
+	for _, p := range sessions {
+		p.Close()
+	}
+}
@@ -0,0 +1,503 @@
+package netserver
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Prefixes of destinations with dynamic upstreams
+const (
+	// srvPrefix marks a destination that is discovered through DNS SRV
+	// records, i.e srv+_db._tcp.service.internal
+	srvPrefix = "srv+"
+
+	// filePrefix marks a destination that is read from a file
+	// which is watched for changes, i.e file+/etc/caddy/upstreams.json
+	filePrefix = "file+"
+)
+
+// discoverTimeout bounds a single discovery of the upstreams of a destination
+const discoverTimeout = 10 * time.Second
+
+// upstream is a single address in an upstream pool
+type upstream struct {
+	addr     string
+	priority int
+	weight   int
+
+	// current is the smooth weighted round-robin state
+	current int
+
+	// unhealthy is set when the last health check failed, accessed atomically
+	unhealthy int32
+
+	// drained upstreams get no new connections or UDP sessions
+	drained bool
+}
+
+// healthy returns true unless the last health check of u failed
+func (u *upstream) healthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+// discoverFunc returns the current upstreams of a destination
+// and how long until they should be discovered again. The
+// upstreams are nil if they didn't change.
+type discoverFunc func(ctx context.Context) ([]*upstream, time.Duration, error)
+
+// upstreamSource is a destination of a proxy server and the
+// upstreams it was last expanded into
+type upstreamSource struct {
+	dest      string
+	discover  discoverFunc
+	upstreams []*upstream
+	removed   chan struct{} // closed when the source is removed from the pool
+}
+
+// upstreamPool holds the addresses a proxy server forwards to.
+// Upstream hostnames are expanded into all their addresses, SRV
+// names into their targets and files are read for a list of
+// addresses. All of these are refreshed in the background.
+// Changes only apply to new connections, existing connections are
+// left alone.
+type upstreamPool struct {
+	resolver *resolver
+	health   *healthChecker
+
+	mu        sync.Mutex
+	sources   []*upstreamSource
+	upstreams []*upstream
+	started   bool
+
+	// weights overrides the weights of upstreams, and drained lists the
+	// drained upstreams, keyed by the upstream address or the destination
+	// it's discovered from
+	weights map[string]int
+	drained map[string]bool
+
+	startOnce sync.Once
+	stopOnce  sync.Once
+	stop      chan struct{}
+}
+
+// newUpstreamPool returns a pool for the destination addresses of a
+// proxy server, with the weights of upstreams that aren't 1. Until their
+// first discovery completes the pool holds hostnames as they are, and
+// nothing for SRV and file destinations.
+func newUpstreamPool(dests []string, weights map[string]int, r *resolver) *upstreamPool {
+	p := &upstreamPool{
+		resolver: r,
+		weights:  make(map[string]int, len(weights)),
+		drained:  make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+	for addr, weight := range weights {
+		p.weights[addr] = weight
+	}
+
+	for _, dest := range dests {
+		src := p.newSource(dest)
+		p.override(src, src.upstreams)
+		p.sources = append(p.sources, src)
+		p.upstreams = append(p.upstreams, src.upstreams...)
+	}
+
+	return p
+}
+
+// newSource returns the source of dest, with the
+// upstreams it's known to have before any discovery
+func (p *upstreamPool) newSource(dest string) *upstreamSource {
+	src := &upstreamSource{
+		dest:      dest,
+		upstreams: []*upstream{{addr: dest, weight: 1}},
+		removed:   make(chan struct{}),
+	}
+
+	if strings.HasPrefix(dest, srvPrefix) {
+		src.upstreams = nil
+		src.discover = discoverSRV(strings.TrimPrefix(dest, srvPrefix), p.resolver)
+	} else if strings.HasPrefix(dest, filePrefix) {
+		src.upstreams = nil
+		src.discover = discoverFile(strings.TrimPrefix(dest, filePrefix))
+	} else if host, port, err := net.SplitHostPort(dest); err == nil && net.ParseIP(host) == nil {
+		src.discover = discoverHost(host, port, p.resolver)
+	}
+	return src
+}
+
+// override applies the weight overrides and drained upstreams of the pool
+// to upstreams of src. The caller must hold p.mu once the pool is in use.
+func (p *upstreamPool) override(src *upstreamSource, upstreams []*upstream) {
+	for _, u := range upstreams {
+		if weight, ok := p.weights[u.addr]; ok {
+			u.weight = weight
+		} else if weight, ok := p.weights[src.dest]; ok {
+			u.weight = weight
+		}
+		u.drained = p.drained[u.addr] || p.drained[src.dest]
+	}
+}
+
+// has returns true if addr is an upstream of the pool or a destination
+// its upstreams are discovered from. The caller must hold p.mu.
+func (p *upstreamPool) has(addr string) bool {
+	for _, src := range p.sources {
+		if src.dest == addr {
+			return true
+		}
+		for _, u := range src.upstreams {
+			if u.addr == addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Add adds the destination dest to the pool with weight, and starts
+// discovering its upstreams if the pool has been started
+func (p *upstreamPool) Add(dest string, weight int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, src := range p.sources {
+		if src.dest == dest {
+			return fmt.Errorf("duplicate upstream %s", dest)
+		}
+	}
+
+	src := p.newSource(dest)
+	p.weights[dest] = weight
+	p.override(src, src.upstreams)
+	p.sources = append(p.sources, src)
+	p.upstreams = append(p.upstreams, src.upstreams...)
+
+	if p.started && src.discover != nil {
+		go func() {
+			p.run(src, p.refresh(src))
+		}()
+	}
+	return nil
+}
+
+// Remove removes the destination dest and the upstreams discovered from it
+// from the pool, and returns false if there is no such destination. The
+// connections to its upstreams are left alone.
+func (p *upstreamPool) Remove(dest string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i, src := range p.sources {
+		if src.dest != dest {
+			continue
+		}
+
+		close(src.removed)
+		p.sources = append(p.sources[:i:i], p.sources[i+1:]...)
+		delete(p.weights, dest)
+		delete(p.drained, dest)
+		p.collect()
+		return true
+	}
+	return false
+}
+
+// SetDrained drains the upstream addr, or all upstreams discovered from
+// the destination addr, or undrains them, and keeps it when the upstreams
+// are discovered again. It returns false if there is no such upstream.
+func (p *upstreamPool) SetDrained(addr string, drained bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.has(addr) {
+		return false
+	}
+
+	if drained {
+		p.drained[addr] = true
+	} else {
+		delete(p.drained, addr)
+	}
+	for _, src := range p.sources {
+		p.override(src, src.upstreams)
+	}
+	return true
+}
+
+// SetWeight changes the weight of the upstream addr, or of all upstreams
+// discovered from the destination addr, and keeps it when the upstreams
+// are discovered again. It returns false if there is no such upstream.
+func (p *upstreamPool) SetWeight(addr string, weight int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.has(addr) {
+		return false
+	}
+
+	p.weights[addr] = weight
+	for _, src := range p.sources {
+		p.override(src, src.upstreams)
+	}
+	return true
+}
+
+// discoverHost returns a discoverFunc which expands
+// host into all of its IPv4 and IPv6 addresses
+func discoverHost(host, port string, r *resolver) discoverFunc {
+	return func(ctx context.Context) ([]*upstream, time.Duration, error) {
+		ips, ttl, err := r.LookupIP(ctx, host)
+		if err != nil {
+			return nil, 0, err
+		}
+		upstreams := make([]*upstream, 0, len(ips))
+		for _, ip := range ips {
+			upstreams = append(upstreams, &upstream{addr: net.JoinHostPort(ip.String(), port), weight: 1})
+		}
+		return upstreams, ttl, nil
+	}
+}
+
+// discoverSRV returns a discoverFunc which expands name into the
+// targets of its SRV records, keeping their priority and weight
+func discoverSRV(name string, r *resolver) discoverFunc {
+	return func(ctx context.Context) ([]*upstream, time.Duration, error) {
+		srvs, ttl, err := r.LookupSRV(ctx, name)
+		if err != nil {
+			return nil, 0, err
+		}
+		upstreams := make([]*upstream, 0, len(srvs))
+		for _, srv := range srvs {
+			upstreams = append(upstreams, &upstream{
+				addr:     net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))),
+				priority: int(srv.Priority),
+				weight:   int(srv.Weight),
+			})
+		}
+		return upstreams, ttl, nil
+	}
+}
+
+// Start discovers the upstream addresses and keeps them up to date,
+// and starts the health checks if configured, until Stop is called.
+// It returns once the first discovery of every destination is done, so
+// that SRV and file destinations have upstreams when the server starts
+// serving. It's safe to call Start more than once.
+func (p *upstreamPool) Start() {
+	p.startOnce.Do(func() {
+		p.mu.Lock()
+		p.started = true
+		var sources []*upstreamSource
+		for _, src := range p.sources {
+			if src.discover != nil {
+				sources = append(sources, src)
+			}
+		}
+		p.mu.Unlock()
+
+		// the destinations are discovered at the same time,
+		// so that Start is bound by the discovery timeout
+		ttls := make([]time.Duration, len(sources))
+		var wg sync.WaitGroup
+		for i, src := range sources {
+			wg.Add(1)
+			go func(i int, src *upstreamSource) {
+				defer wg.Done()
+				ttls[i] = p.refresh(src)
+			}(i, src)
+		}
+		wg.Wait()
+		for i, src := range sources {
+			go p.run(src, ttls[i])
+		}
+
+		if p.health != nil {
+			go p.health.run(p, p.stop)
+		}
+	})
+}
+
+// Stop stops refreshing the upstream addresses
+func (p *upstreamPool) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// run discovers the upstreams of src again every time
+// their TTL, starting with ttl, runs out
+func (p *upstreamPool) run(src *upstreamSource, ttl time.Duration) {
+	for {
+		select {
+		case <-time.After(ttl):
+		case <-src.removed:
+			return
+		case <-p.stop:
+			return
+		}
+		ttl = p.refresh(src)
+	}
+}
+
+// refresh discovers the upstreams of src and returns
+// how long until they should be discovered again
+func (p *upstreamPool) refresh(src *upstreamSource) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+	defer cancel()
+
+	upstreams, ttl, err := src.discover(ctx)
+	if err != nil {
+		// keep the last known upstreams and retry
+		log.Printf("[ERROR] Discovering upstreams of %s: %v", src.dest, err)
+		return minResolverTTL * 5
+	}
+	if upstreams != nil {
+		p.set(src, upstreams)
+	}
+	return ttl
+}
+
+// set replaces the upstreams of src in the pool. Upstreams that
+// are already in the pool keep their balancing and health state.
+func (p *upstreamPool) set(src *upstreamSource, upstreams []*upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-src.removed:
+		// removed while discovering
+		return
+	default:
+	}
+
+	existing := make(map[string]*upstream, len(src.upstreams))
+	for _, u := range src.upstreams {
+		existing[u.addr] = u
+	}
+	for _, u := range upstreams {
+		if old, ok := existing[u.addr]; ok {
+			u.current = old.current
+			u.unhealthy = atomic.LoadInt32(&old.unhealthy)
+		}
+	}
+	p.override(src, upstreams)
+	src.upstreams = upstreams
+	p.collect()
+}
+
+// collect gathers the upstreams of all sources of
+// the pool in p.upstreams. The caller must hold p.mu.
+func (p *upstreamPool) collect() {
+	p.upstreams = nil
+	for _, src := range p.sources {
+		p.upstreams = append(p.upstreams, src.upstreams...)
+	}
+}
+
+// all returns the upstreams currently in the pool
+func (p *upstreamPool) all() []*upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	upstreams := make([]*upstream, len(p.upstreams))
+	copy(upstreams, p.upstreams)
+	return upstreams
+}
+
+// views returns the upstreams currently in the pool for the admin API
+func (p *upstreamPool) views() []upstreamView {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	views := make([]upstreamView, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		views = append(views, upstreamView{Addr: u.addr, Priority: u.priority, Weight: u.weight, Healthy: u.healthy(), Drained: u.drained})
+	}
+	return views
+}
+
+// active returns the addresses of the upstreams that aren't drained
+func (p *upstreamPool) active() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	addrs := make([]string, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !u.drained {
+			addrs = append(addrs, u.addr)
+		}
+	}
+	return addrs
+}
+
+// Addrs returns the addresses in the pool in the order they should be
+// tried. The first address is chosen by smooth weighted round-robin
+// among the healthy upstreams with the best (lowest) priority, the
+// others follow by priority and weight as fallbacks. Unhealthy
+// upstreams come last, in case all upstreams are unhealthy. Drained
+// upstreams are left out.
+func (p *upstreamPool) Addrs() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sorted := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if !u.drained {
+			sorted = append(sorted, u)
+		}
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].healthy() != sorted[j].healthy() {
+			return sorted[i].healthy()
+		}
+		if sorted[i].priority != sorted[j].priority {
+			return sorted[i].priority < sorted[j].priority
+		}
+		return sorted[i].weight > sorted[j].weight
+	})
+
+	// upstreams with a weight of 0 are only picked
+	// if all upstreams of the priority have weight 0
+	best, healthy := sorted[0].priority, sorted[0].healthy()
+	zero := sorted[0].weight == 0
+	total := 0
+	var picked *upstream
+	for _, u := range sorted {
+		if u.priority != best || u.healthy() != healthy {
+			break
+		}
+		weight := u.weight
+		if zero {
+			weight = 1
+		}
+		u.current += weight
+		total += weight
+		if picked == nil || u.current > picked.current {
+			picked = u
+		}
+	}
+	picked.current -= total
+
+	addrs := make([]string, 0, len(sorted))
+	addrs = append(addrs, picked.addr)
+	for _, u := range sorted {
+		if u != picked {
+			addrs = append(addrs, u.addr)
+		}
+	}
+
+	return addrs
+}
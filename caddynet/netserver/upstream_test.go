@@ -0,0 +1,62 @@
+package netserver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestUpstreamPoolStartDiscovers has the upstreams of SRV and
+// file destinations as soon as Start returns
+func TestUpstreamPoolStartDiscovers(t *testing.T) {
+	s := startDNSServer(t, "_db._tcp.test. 60 IN SRV 10 1 5432 a.test.")
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstreams.txt")
+	if err := ioutil.WriteFile(path, []byte("10.0.0.5:5432\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newResolver(ResolverConfig{Servers: []string{s.addr}})
+	p := newUpstreamPool([]string{"srv+_db._tcp.test", "file+" + path}, nil, r)
+	if addrs := p.Addrs(); len(addrs) != 0 {
+		t.Errorf("got %v before Start, want none", addrs)
+	}
+	p.Start()
+	defer p.Stop()
+
+	// the upstream of the file has the better priority, 0
+	addrs := p.Addrs()
+	if len(addrs) != 2 || addrs[0] != "10.0.0.5:5432" || addrs[1] != "a.test:5432" {
+		t.Errorf("got %v, want [10.0.0.5:5432 a.test:5432]", addrs)
+	}
+}
+
+// TestUpstreamPoolStartFailing returns from Start at
+// once when the first discovery fails
+func TestUpstreamPoolStartFailing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upstreams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstreams.txt")
+
+	p := newUpstreamPool([]string{"file+" + path}, nil, nil)
+	start := time.Now()
+	p.Start()
+	defer p.Stop()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Start took %v", d)
+	}
+	if addrs := p.Addrs(); len(addrs) != 0 {
+		t.Errorf("got %v from a missing file, want none", addrs)
+	}
+}
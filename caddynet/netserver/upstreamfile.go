@@ -0,0 +1,124 @@
+package netserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fileWatchInterval is how often an upstream file is checked for changes
+const fileWatchInterval = time.Second
+
+// fileUpstream is an upstream as it appears in a JSON upstream file
+type fileUpstream struct {
+	Address  string `json:"address"`
+	Weight   *int   `json:"weight"`
+	Priority int    `json:"priority"`
+}
+
+// discoverFile returns a discoverFunc which reads the upstreams from
+// the file at path whenever its size or modification time changes.
+// The file is either a JSON array of addresses or upstream objects:
+//
+//	["10.0.0.5:5432", {"address": "10.0.0.6:5432", "weight": 3, "priority": 0}]
+//
+// or a plain text file with an address and optional weight per line:
+//
+//	# comments and blank lines are ignored
+//	10.0.0.5:5432
+//	10.0.0.6:5432 3
+//
+// Write the file to a temporary location and rename it into place
+// so that a partially written file is never read.
+func discoverFile(path string) discoverFunc {
+	var lastMod time.Time
+	var lastSize int64 = -1
+
+	return func(ctx context.Context) ([]*upstream, time.Duration, error) {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, fileWatchInterval, err
+		}
+		if info.ModTime().Equal(lastMod) && info.Size() == lastSize {
+			return nil, fileWatchInterval, nil
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, fileWatchInterval, err
+		}
+
+		upstreams, err := parseUpstreamFile(data)
+		if err != nil {
+			return nil, fileWatchInterval, fmt.Errorf("parsing %s: %v", path, err)
+		}
+
+		lastMod, lastSize = info.ModTime(), info.Size()
+		return upstreams, fileWatchInterval, nil
+	}
+}
+
+// parseUpstreamFile parses the contents of an upstream file. The result
+// is never nil, an empty file removes all upstreams from the pool.
+func parseUpstreamFile(data []byte) ([]*upstream, error) {
+	upstreams := []*upstream{}
+
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(trimmed, &entries); err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			var addr string
+			if err := json.Unmarshal(entry, &addr); err == nil {
+				upstreams = append(upstreams, &upstream{addr: addr, weight: 1})
+				continue
+			}
+
+			var fu fileUpstream
+			if err := json.Unmarshal(entry, &fu); err != nil {
+				return nil, err
+			}
+			if fu.Address == "" {
+				return nil, fmt.Errorf("upstream without address: %s", entry)
+			}
+			u := &upstream{addr: fu.Address, priority: fu.Priority, weight: 1}
+			if fu.Weight != nil {
+				if *fu.Weight < 0 {
+					return nil, fmt.Errorf("negative weight for %s", fu.Address)
+				}
+				u.weight = *fu.Weight
+			}
+			upstreams = append(upstreams, u)
+		}
+		return upstreams, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		u := &upstream{addr: fields[0], weight: 1}
+		if len(fields) > 1 {
+			weight, err := strconv.Atoi(fields[1])
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight for %s: %s", fields[0], fields[1])
+			}
+			u.weight = weight
+		}
+		upstreams = append(upstreams, u)
+	}
+
+	return upstreams, scanner.Err()
+}
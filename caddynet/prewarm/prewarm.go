@@ -0,0 +1,88 @@
+package prewarm
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("prewarm", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupPrewarm,
+	})
+}
+
+// setupPrewarm parses the prewarm directive which keeps idle connections
+// to each upstream of a proxy server block ready for new clients:
+//
+//	prewarm {
+//		min      4
+//		max      16
+//		max_idle 30s
+//	}
+func setupPrewarm(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupPrewarm if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		if !config.ServesTCP() {
+			return c.Err("prewarm requires the tcp transport")
+		}
+
+		prewarm := netserver.PrewarmConfig{Min: 1, MaxIdle: netserver.DefaultPrewarmMaxIdle}
+		for c.NextBlock() {
+			property := c.Val()
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			switch property {
+			case "min", "max":
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 0 {
+					return c.Errf("invalid prewarm %s '%s'", property, c.Val())
+				}
+				if property == "min" {
+					prewarm.Min = n
+				} else {
+					prewarm.Max = n
+				}
+
+			case "max_idle":
+				d, err := time.ParseDuration(c.Val())
+				if err != nil || d < 0 {
+					return c.Errf("invalid prewarm max_idle '%s'", c.Val())
+				}
+				prewarm.MaxIdle = d
+
+			default:
+				return c.Errf("unknown prewarm property '%s'", property)
+			}
+
+			if c.NextArg() {
+				// only one argument allowed
+				return c.ArgErr()
+			}
+		}
+
+		if prewarm.Max == 0 {
+			prewarm.Max = prewarm.Min
+		}
+		if prewarm.Max < prewarm.Min {
+			return c.Err("prewarm max is less than min")
+		}
+		config.Prewarm = prewarm
+	}
+
+	return nil
+}
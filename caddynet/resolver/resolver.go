@@ -0,0 +1,74 @@
+package resolver
+
+import (
+	"net"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("resolver", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupResolver,
+	})
+}
+
+// setupResolver parses the resolver directive which configures the
+// DNS servers used to look up the upstream of a proxy server block:
+//
+//	resolver 10.0.0.2 10.0.0.3:5353 {
+//		min_ttl 5s
+//		max_ttl 5m
+//	}
+func setupResolver(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupResolver if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		for _, server := range c.RemainingArgs() {
+			if _, _, err := net.SplitHostPort(server); err != nil {
+				server = net.JoinHostPort(server, "53")
+			}
+			config.Resolver.Servers = append(config.Resolver.Servers, server)
+		}
+
+		for c.NextBlock() {
+			var ttl *time.Duration
+			property := c.Val()
+			switch property {
+			case "min_ttl":
+				ttl = &config.Resolver.MinTTL
+			case "max_ttl":
+				ttl = &config.Resolver.MaxTTL
+			default:
+				return c.Errf("unknown resolver property '%s'", property)
+			}
+
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			d, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return c.Errf("invalid %s: %v", property, err)
+			}
+			*ttl = d
+
+			if c.NextArg() {
+				// only one argument allowed
+				return c.ArgErr()
+			}
+		}
+	}
+
+	if config.Resolver.MaxTTL > 0 && config.Resolver.MinTTL > config.Resolver.MaxTTL {
+		return c.Err("min_ttl is greater than max_ttl")
+	}
+
+	return nil
+}
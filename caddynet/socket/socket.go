@@ -0,0 +1,123 @@
+package socket
+
+import (
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("socket", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupSocket,
+	})
+}
+
+// setupSocket parses the socket directive which sets the socket options
+// of the listeners of a server block and of the connections to its upstreams:
+//
+//	socket {
+//		keepalive      30s|off
+//		nodelay        on|off
+//		reuseport      4
+//		fastopen
+//		mptcp
+//		send_buffer    262144
+//		receive_buffer 262144
+//	}
+//
+// reuseport and fastopen are only supported on Linux.
+func setupSocket(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupSocket if the key is not echo or proxy
+	if c.Key != "echo" && c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			property := c.Val()
+			args := c.RemainingArgs()
+
+			switch property {
+			case "fastopen", "mptcp":
+				if len(args) != 0 {
+					return c.ArgErr()
+				}
+				if !config.ServesTCP() {
+					return c.Errf("%s requires the tcp transport", property)
+				}
+				if property == "fastopen" && runtime.GOOS != "linux" {
+					return c.Errf("fastopen is only supported on Linux")
+				}
+				if property == "fastopen" {
+					config.Socket.FastOpen = true
+				} else {
+					config.Socket.MPTCP = true
+				}
+				continue
+			}
+
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+
+			switch property {
+			case "keepalive":
+				if args[0] == "off" {
+					config.Socket.KeepAlive = -1
+					break
+				}
+				d, err := time.ParseDuration(args[0])
+				if err != nil || d <= 0 {
+					return c.Errf("invalid keepalive '%s'", args[0])
+				}
+				config.Socket.KeepAlive = d
+
+			case "nodelay":
+				switch args[0] {
+				case "on":
+					config.Socket.NoDelay = true
+				case "off":
+					config.Socket.NoDelay = false
+				default:
+					return c.Errf("invalid nodelay '%s', must be on or off", args[0])
+				}
+
+			case "reuseport":
+				if runtime.GOOS != "linux" {
+					return c.Errf("reuseport is only supported on Linux")
+				}
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 1 {
+					return c.Errf("invalid reuseport '%s'", args[0])
+				}
+				config.Socket.ReusePort = n
+
+			case "send_buffer", "receive_buffer":
+				n, err := strconv.Atoi(args[0])
+				if err != nil || n < 1 {
+					return c.Errf("invalid %s '%s'", property, args[0])
+				}
+				if property == "send_buffer" {
+					config.Socket.SendBuffer = n
+				} else {
+					config.Socket.ReceiveBuffer = n
+				}
+
+			default:
+				return c.Errf("unknown socket property '%s'", property)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package token
+
+import (
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("token", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupToken,
+	})
+}
+
+// setupToken parses the token directive which sets the bearer token
+// clients of an admin server block must send. Environment variables
+// keep it out of the Caddyfile:
+//
+//	token {$CADDYNET_ADMIN_TOKEN}
+func setupToken(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupToken if the key is not admin
+	if c.Key != "admin" {
+		return nil
+	}
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		if len(args) != 1 || args[0] == "" {
+			return c.ArgErr()
+		}
+		config.Token = args[0]
+	}
+
+	return nil
+}
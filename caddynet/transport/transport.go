@@ -0,0 +1,48 @@
+package transport
+
+import (
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("transport", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupTransport,
+	})
+}
+
+func setupTransport(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupTransport if the key is not echo or proxy
+	if c.Key != "echo" && c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+
+		transport := c.Val()
+		switch transport {
+		case netserver.TransportTCP, netserver.TransportUDP, netserver.TransportBoth:
+		default:
+			return c.Errf("unknown transport '%s', expected tcp, udp or both", transport)
+		}
+
+		// a transport prefix on the listen address can't be overridden
+		if config.Transport != "" && config.Transport != transport {
+			return c.Errf("transport '%s' conflicts with listen address prefix '%s/'", transport, config.Transport)
+		}
+		config.Transport = transport
+
+		if c.NextArg() {
+			// only one argument allowed
+			return c.ArgErr()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package udp
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("udp", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupUDP,
+	})
+}
+
+// setupUDP parses the udp directive which configures
+// the UDP sessions of a proxy server block, the workers
+// of an echo server block and the datagram batching and
+// buffer size of both:
+//
+//	udp {
+//		idle_timeout      60s
+//		max_sessions      10000
+//		queue_size        128
+//		batch_size        32
+//		workers           8
+//		max_datagram_size 4096
+//	}
+func setupUDP(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupUDP if the key is not echo or proxy
+	if c.Key != "echo" && c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			property := c.Val()
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+
+			switch property {
+			case "idle_timeout", "max_sessions", "queue_size":
+				if c.Key != "proxy" {
+					return c.Errf("udp property '%s' is only supported by proxy", property)
+				}
+			case "workers":
+				if c.Key != "echo" {
+					return c.Errf("udp property '%s' is only supported by echo", property)
+				}
+			}
+
+			switch property {
+			case "idle_timeout":
+				d, err := time.ParseDuration(c.Val())
+				if err != nil || d < 0 {
+					return c.Errf("invalid idle_timeout '%s'", c.Val())
+				}
+				config.UDP.IdleTimeout = d
+
+			case "max_sessions":
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 0 {
+					return c.Errf("invalid max_sessions '%s'", c.Val())
+				}
+				config.UDP.MaxSessions = n
+
+			case "queue_size":
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return c.Errf("invalid queue_size '%s'", c.Val())
+				}
+				config.UDP.QueueSize = n
+
+			case "batch_size":
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return c.Errf("invalid batch_size '%s'", c.Val())
+				}
+				config.UDP.BatchSize = n
+
+			case "workers":
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 {
+					return c.Errf("invalid workers '%s'", c.Val())
+				}
+				config.UDP.Workers = n
+
+			case "max_datagram_size":
+				n, err := strconv.Atoi(c.Val())
+				if err != nil || n < 1 || n > 65535 {
+					return c.Errf("invalid max_datagram_size '%s'", c.Val())
+				}
+				config.UDP.MaxDatagramSize = n
+
+			default:
+				return c.Errf("unknown udp property '%s'", property)
+			}
+
+			if c.NextArg() {
+				// only one argument allowed
+				return c.ArgErr()
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package upstream
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy"
+	"github.com/pieterlouw/caddy-net/caddynet/netserver"
+)
+
+func init() {
+	caddy.RegisterPlugin("upstream", caddy.Plugin{
+		ServerType: "net",
+		Action:     setupUpstream,
+	})
+}
+
+// setupUpstream parses the upstream directive which adds addresses
+// to the pool a proxy server block balances traffic across. Addresses
+// in a block may be followed by their weight, which is 1 otherwise:
+//
+//	upstream 10.0.0.6:53 10.0.0.7:53
+//	upstream {
+//		10.0.0.8:53 3
+//	}
+func setupUpstream(c *caddy.Controller) error {
+	config := netserver.GetConfig(c)
+
+	// Ignore call to setupUpstream if the key is not proxy
+	if c.Key != "proxy" {
+		return nil
+	}
+
+	for c.Next() {
+		args := c.RemainingArgs()
+		config.Upstreams = append(config.Upstreams, args...)
+
+		for c.NextBlock() {
+			addr := c.Val()
+			args = append(args, addr)
+			config.Upstreams = append(config.Upstreams, addr)
+
+			weights := c.RemainingArgs()
+			if len(weights) > 1 {
+				return c.ArgErr()
+			}
+			if len(weights) == 1 {
+				weight, err := strconv.Atoi(weights[0])
+				if err != nil || weight < 0 {
+					return c.Errf("invalid weight '%s'", weights[0])
+				}
+				if config.Weights == nil {
+					config.Weights = make(map[string]int)
+				}
+				config.Weights[addr] = weight
+			}
+		}
+
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+	}
+
+	return nil
+}
@@ -5,4 +5,6 @@ go 1.13
 require (
 	github.com/caddyserver/caddy v1.0.5
 	github.com/mholt/certmagic v0.8.3
+	github.com/miekg/dns v1.1.15
+	golang.org/x/net v0.0.0-20191027093000-83d349e8ac1a
 )